@@ -5,9 +5,32 @@ import (
 	"time"
 )
 
+// A Ticker delivers the time on its channel at regular intervals. It has the
+// same semantics as time.Ticker: if the receiver falls behind, ticks are
+// dropped rather than queued.
 type Ticker interface {
 	C() <-chan time.Time
 	Stop()
+
+	// Stops the ticker and resets its period to d. The next tick arrives after
+	// the new period has elapsed.
+	Reset(d time.Duration)
+}
+
+// A Timer is a single event which fires after a duration has elapsed on the
+// clock which created it. It has the same semantics as time.Timer.
+type Timer interface {
+	// The channel on which the time is delivered when the timer fires. Timers
+	// created with AfterFunc have no channel, and return nil.
+	C() <-chan time.Time
+
+	// Prevents the timer from firing. Returns true if the call stopped the
+	// timer, or false if the timer had already fired or been stopped.
+	Stop() bool
+
+	// Changes the timer to fire after duration d, counted from now. Returns
+	// true if the timer had been active.
+	Reset(d time.Duration) bool
 }
 
 type Clock interface {
@@ -15,6 +38,14 @@ type Clock interface {
 	Sleep(time.Duration)
 	After(time.Duration) <-chan time.Time
 	NewTicker(time.Duration) Ticker
+	NewTimer(time.Duration) Timer
+
+	// Calls f after the duration has elapsed. The returned Timer can be used to
+	// cancel the call. The real clock calls f in its own goroutine; fake clocks
+	// call it synchronously from Advance, so f must not block. If the duration
+	// is not positive, fake clocks behave like the real clock and call f in its
+	// own goroutine, since the caller may hold locks which f needs.
+	AfterFunc(time.Duration, func()) Timer
 }
 
 var Real Clock
@@ -41,6 +72,14 @@ func (realClock) NewTicker(d time.Duration) Ticker {
 	return realTicker{time.NewTicker(d)}
 }
 
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
 type realTicker struct {
 	*time.Ticker
 }
@@ -49,15 +88,242 @@ func (rt realTicker) C() <-chan time.Time {
 	return rt.Ticker.C
 }
 
+type realTimer struct {
+	*time.Timer
+}
+
+func (rt realTimer) C() <-chan time.Time {
+	return rt.Timer.C
+}
+
 type Fake interface {
 	Clock
+
+	// Moves the clock forward by the given duration. Timers whose deadlines are
+	// passed fire in deadline order, and the clock reads each deadline in turn
+	// as its timer fires.
 	Advance(time.Duration)
+
+	// Blocks until at least n sleepers are waiting on the clock. A sleeper is a
+	// pending After, Sleep, Timer or AfterFunc. This allows a test to wait for
+	// the code under test to start waiting before calling Advance.
+	BlockUntil(n int)
+
+	// Returns the deadlines of the sleepers currently waiting on the clock, in
+	// the order in which they will fire.
+	PendingSleepers() []time.Time
+}
+
+// State shared by the fake clocks: the current time and the sleepers waiting
+// on it, kept in deadline order.
+type fakeCore struct {
+	t        time.Time
+	mutex    sync.RWMutex
+	sleepers []*sleeper
+	blockers []*blocker
+}
+
+// A goroutine waiting in BlockUntil.
+type blocker struct {
+	n  int
+	ch chan struct{}
+}
+
+// A sleeper is anything waiting for the fake time to reach a given point:
+// an After call, a Timer or a Ticker. Exactly one of done and f is set. If
+// period is nonzero, the sleeper is rescheduled each time it fires.
+type sleeper struct {
+	core    *fakeCore
+	until   time.Time
+	period  time.Duration
+	c       chan time.Time
+	done    chan<- time.Time
+	f       func()
+	pending bool
+}
+
+func (c *fakeCore) Now() time.Time {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	t := c.t
+	return t
+}
+
+// Inserts a sleeper after any sleepers with the same or an earlier deadline.
+// Lock must be held.
+func (c *fakeCore) lAdd(s *sleeper) {
+	i := len(c.sleepers)
+	for i > 0 && c.sleepers[i-1].until.After(s.until) {
+		i--
+	}
+
+	c.sleepers = append(c.sleepers, nil)
+	copy(c.sleepers[i+1:], c.sleepers[i:])
+	c.sleepers[i] = s
+	s.pending = true
+
+	var blockers []*blocker
+	for _, b := range c.blockers {
+		if len(c.sleepers) >= b.n {
+			close(b.ch)
+		} else {
+			blockers = append(blockers, b)
+		}
+	}
+	c.blockers = blockers
+}
+
+// Removes a sleeper. Returns false if it was not pending. Lock must be held.
+func (c *fakeCore) lRemove(s *sleeper) bool {
+	if !s.pending {
+		return false
+	}
+
+	for i, s2 := range c.sleepers {
+		if s2 == s {
+			c.sleepers = append(c.sleepers[:i], c.sleepers[i+1:]...)
+			break
+		}
+	}
+
+	s.pending = false
+	return true
+}
+
+// Registers a sleeper due after d. If d is not positive, the sleeper fires
+// immediately; an AfterFunc function is started in its own goroutine, as the
+// lock is held. Lock must be held.
+func (c *fakeCore) lSchedule(s *sleeper, d time.Duration) {
+	s.until = c.t.Add(d)
+	if d > 0 {
+		c.lAdd(s)
+		return
+	}
+
+	if s.f != nil {
+		go s.f()
+	} else {
+		trySend(s.done, c.t)
+	}
+}
+
+func (c *fakeCore) after(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	done := make(chan time.Time, 1)
+	c.lSchedule(&sleeper{core: c, done: done}, d)
+	return done
+}
+
+// Moves time forward, firing sleepers in deadline order. AfterFunc functions
+// are called synchronously without the lock held, so they may use the clock.
+func (c *fakeCore) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	t2 := c.t.Add(d)
+	for len(c.sleepers) > 0 && !c.sleepers[0].until.After(t2) {
+		s := c.sleepers[0]
+		c.sleepers = c.sleepers[1:]
+		s.pending = false
+		if s.until.After(c.t) {
+			c.t = s.until
+		}
+
+		if s.f != nil {
+			c.mutex.Unlock()
+			s.f()
+			c.mutex.Lock()
+		} else {
+			trySend(s.done, c.t)
+		}
+
+		if s.period > 0 && !s.pending {
+			s.until = s.until.Add(s.period)
+			c.lAdd(s)
+		}
+	}
+
+	// A callback may have moved the clock further on.
+	if t2.After(c.t) {
+		c.t = t2
+	}
+}
+
+func (c *fakeCore) BlockUntil(n int) {
+	c.mutex.Lock()
+	if len(c.sleepers) >= n {
+		c.mutex.Unlock()
+		return
+	}
+
+	b := &blocker{n: n, ch: make(chan struct{})}
+	c.blockers = append(c.blockers, b)
+	c.mutex.Unlock()
+	<-b.ch
+}
+
+func (c *fakeCore) PendingSleepers() []time.Time {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	ts := make([]time.Time, len(c.sleepers))
+	for i, s := range c.sleepers {
+		ts[i] = s.until
+	}
+	return ts
+}
+
+func (c *fakeCore) NewTimer(d time.Duration) Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ch := make(chan time.Time, 1)
+	s := &sleeper{core: c, c: ch, done: ch}
+	c.lSchedule(s, d)
+	return s
+}
+
+func (c *fakeCore) AfterFunc(d time.Duration, f func()) Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	s := &sleeper{core: c, f: f}
+	c.lSchedule(s, d)
+	return s
+}
+
+func (s *sleeper) C() <-chan time.Time {
+	return s.c
+}
+
+func (s *sleeper) Stop() bool {
+	s.core.mutex.Lock()
+	defer s.core.mutex.Unlock()
+	return s.core.lRemove(s)
+}
+
+func (s *sleeper) Reset(d time.Duration) bool {
+	s.core.mutex.Lock()
+	defer s.core.mutex.Unlock()
+	wasPending := s.core.lRemove(s)
+	s.core.lSchedule(s, d)
+	return wasPending
+}
+
+func trySend(ch chan<- time.Time, t time.Time) {
+	select {
+	case ch <- t:
+	default:
+	}
 }
 
 // A fast fake clock returns from Sleep calls immediately.
 //
 // Any waiting operation appears to complete immediately, as though time is
-// running infinitely fast, but only when waiting.
+// running infinitely fast, but only when waiting. Timers and tickers fire
+// when the clock is moved past their deadline by Sleep, After or Advance.
 func NewFast(from Clock) Fake {
 	if from == nil {
 		from = Real
@@ -67,25 +333,15 @@ func NewFast(from Clock) Fake {
 }
 
 func NewFastAt(t time.Time) Fake {
-	return &fastFake{t: t}
+	return &fastFake{fakeCore{t: t}}
 }
 
 type fastFake struct {
-	t     time.Time
-	mutex sync.RWMutex
-}
-
-func (f *fastFake) Now() time.Time {
-	f.mutex.RLock()
-	defer f.mutex.RUnlock()
-	t := f.t
-	return t
+	fakeCore
 }
 
 func (f *fastFake) Sleep(d time.Duration) {
-	f.mutex.Lock()
-	defer f.mutex.Unlock()
-	f.t = f.t.Add(d)
+	f.advance(d)
 }
 
 func (f *fastFake) Advance(d time.Duration) {
@@ -100,7 +356,7 @@ func (f *fastFake) After(d time.Duration) <-chan time.Time {
 }
 
 func (f *fastFake) NewTicker(d time.Duration) Ticker {
-	return newFakeTicker(f, d)
+	return f.newTicker(d)
 }
 
 // A slow clock doesn't return from Sleep calls until Advance has been called
@@ -114,25 +370,11 @@ func NewSlow(from Clock) Fake {
 }
 
 func NewSlowAt(t time.Time) Fake {
-	return &slowFake{t: t}
+	return &slowFake{fakeCore{t: t}}
 }
 
 type slowFake struct {
-	t        time.Time
-	mutex    sync.RWMutex
-	sleepers []*slowSleeper
-}
-
-type slowSleeper struct {
-	until time.Time
-	done  chan<- time.Time
-}
-
-func (f *slowFake) Now() time.Time {
-	f.mutex.RLock()
-	defer f.mutex.RUnlock()
-	t := f.t
-	return t
+	fakeCore
 }
 
 func (f *slowFake) Sleep(d time.Duration) {
@@ -140,79 +382,56 @@ func (f *slowFake) Sleep(d time.Duration) {
 }
 
 func (f *slowFake) Advance(d time.Duration) {
-	f.mutex.Lock()
-	defer f.mutex.Unlock()
-
-	t2 := f.t.Add(d)
-	var newSleepers []*slowSleeper
-	for _, s := range f.sleepers {
-		if t2.Sub(s.until) >= 0 {
-			s.done <- t2
-		} else {
-			newSleepers = append(newSleepers, s)
-		}
-	}
-
-	f.sleepers = newSleepers
-	f.t = t2
+	f.advance(d)
 }
 
 func (f *slowFake) After(d time.Duration) <-chan time.Time {
-	f.mutex.Lock()
-	defer f.mutex.Unlock()
-
-	done := make(chan time.Time, 1)
-	if d == 0 {
-		done <- f.t
-		return done
-	}
-
-	s := &slowSleeper{
-		until: f.t.Add(d),
-		done:  done,
-	}
-
-	f.sleepers = append(f.sleepers, s)
-	return done
+	return f.after(d)
 }
 
 func (f *slowFake) NewTicker(d time.Duration) Ticker {
-	return newFakeTicker(f, d)
+	return f.newTicker(d)
 }
 
+// A fake ticker is a periodic sleeper. It is rescheduled each time it fires,
+// so it costs nothing between ticks and holds no resources once stopped.
 type fakeTicker struct {
-	clock    Clock
-	c        chan time.Time
-	stopChan chan struct{}
+	s *sleeper
 }
 
-func newFakeTicker(c Clock, d time.Duration) Ticker {
-	ft := &fakeTicker{
-		clock:    c,
-		c:        make(chan time.Time, 1),
-		stopChan: make(chan struct{}),
+func (c *fakeCore) newTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
 	}
-	go ft.tickLoop(d)
-	return ft
-}
 
-func (ft *fakeTicker) tickLoop(d time.Duration) {
-	for {
-		ft.clock.Sleep(d)
-		select {
-		case ft.c <- ft.clock.Now():
-		case <-ft.stopChan:
-			return
-		}
-	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ch := make(chan time.Time, 1)
+	s := &sleeper{core: c, c: ch, done: ch, period: d}
+	c.lSchedule(s, d)
+	return &fakeTicker{s}
 }
 
 func (ft *fakeTicker) C() <-chan time.Time {
-	return ft.c
+	return ft.s.c
 }
 
 func (ft *fakeTicker) Stop() {
-	close(ft.stopChan)
+	ft.s.Stop()
+}
+
+func (ft *fakeTicker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("non-positive interval for Ticker.Reset")
+	}
+
+	c := ft.s.core
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lRemove(ft.s)
+	ft.s.period = d
+	c.lSchedule(ft.s, d)
 }
 
 // © 2015 Jonathan Boulle   Apache 2.0 License
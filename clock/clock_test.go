@@ -0,0 +1,223 @@
+package clock
+
+import "golang.org/x/net/context"
+import "sync"
+import "testing"
+import "time"
+
+var epoch = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestTimerOrder(t *testing.T) {
+	for _, f := range []Fake{NewSlowAt(epoch), NewFastAt(epoch)} {
+		var fired []time.Duration
+		for _, d := range []time.Duration{3 * time.Second, 1 * time.Second, 2 * time.Second} {
+			d := d
+			f.AfterFunc(d, func() {
+				if f.Now().Sub(epoch) != d {
+					t.Errorf("timer %v fired at %v", d, f.Now().Sub(epoch))
+				}
+				fired = append(fired, d)
+			})
+		}
+
+		f.Advance(5 * time.Second)
+		if len(fired) != 3 || fired[0] != 1*time.Second || fired[1] != 2*time.Second || fired[2] != 3*time.Second {
+			t.Fatalf("timers fired out of order: %v", fired)
+		}
+		if f.Now() != epoch.Add(5*time.Second) {
+			t.Fatalf("wrong time after advance: %v", f.Now())
+		}
+	}
+}
+
+func TestTimerStopReset(t *testing.T) {
+	f := NewSlowAt(epoch)
+	tm := f.NewTimer(time.Second)
+	if !tm.Stop() {
+		t.Fatalf("stop of pending timer returned false")
+	}
+	if tm.Stop() {
+		t.Fatalf("second stop returned true")
+	}
+
+	f.Advance(2 * time.Second)
+	select {
+	case <-tm.C():
+		t.Fatalf("stopped timer fired")
+	default:
+	}
+
+	if tm.Reset(time.Second) {
+		t.Fatalf("reset of stopped timer returned true")
+	}
+
+	f.Advance(999 * time.Millisecond)
+	select {
+	case <-tm.C():
+		t.Fatalf("timer fired early")
+	default:
+	}
+
+	f.Advance(time.Millisecond)
+	select {
+	case v := <-tm.C():
+		if v != epoch.Add(3*time.Second) {
+			t.Fatalf("unexpected timer value: %v", v)
+		}
+	default:
+		t.Fatalf("timer did not fire")
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	f := NewSlowAt(epoch)
+	ctx, cancel := WithTimeout(context.Background(), f, 10*time.Second)
+	defer cancel()
+
+	if dl, ok := ctx.Deadline(); !ok || dl != epoch.Add(10*time.Second) {
+		t.Fatalf("unexpected deadline: %v", dl)
+	}
+
+	f.Advance(9 * time.Second)
+	select {
+	case <-ctx.Done():
+		t.Fatalf("context cancelled early")
+	default:
+	}
+
+	f.Advance(1 * time.Second)
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatalf("context not cancelled after deadline")
+	}
+
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", ctx.Err())
+	}
+
+	ctx, cancel = WithTimeout(context.Background(), f, 10*time.Second)
+	cancel()
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("unexpected error: %v", ctx.Err())
+	}
+}
+
+func TestNestedAdvance(t *testing.T) {
+	for _, f := range []Fake{NewSlowAt(epoch), NewFastAt(epoch)} {
+		var inner time.Time
+		f.AfterFunc(1*time.Second, func() {
+			f.Advance(5 * time.Second)
+			inner = f.Now()
+		})
+
+		f.Advance(2 * time.Second)
+		if !inner.Equal(epoch.Add(6*time.Second)) || !f.Now().Equal(inner) {
+			t.Fatalf("nested advance rolled back: inner %v, now %v", inner, f.Now())
+		}
+	}
+}
+
+func TestZeroAfterFunc(t *testing.T) {
+	for _, f := range []Fake{NewSlowAt(epoch), NewFastAt(epoch)} {
+		// f may take a lock which the caller of AfterFunc holds.
+		var mutex sync.Mutex
+		done := make(chan time.Time, 1)
+		mutex.Lock()
+		f.AfterFunc(0, func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			done <- f.Now()
+		})
+		mutex.Unlock()
+
+		if v := <-done; !v.Equal(epoch) {
+			t.Fatalf("zero AfterFunc fired at %v", v)
+		}
+	}
+}
+
+func TestBlockUntil(t *testing.T) {
+	f := NewSlowAt(epoch)
+	done := make(chan struct{})
+	go func() {
+		f.Sleep(5 * time.Second)
+		close(done)
+	}()
+
+	f.BlockUntil(1)
+	ps := f.PendingSleepers()
+	if len(ps) != 1 || ps[0] != epoch.Add(5*time.Second) {
+		t.Fatalf("unexpected pending sleepers: %v", ps)
+	}
+
+	f.Advance(5 * time.Second)
+	<-done
+
+	if len(f.PendingSleepers()) != 0 {
+		t.Fatalf("sleeper still pending after wakeup")
+	}
+}
+
+func TestTicker(t *testing.T) {
+	f := NewSlowAt(epoch)
+	tk := f.NewTicker(time.Second)
+
+	// A slow receiver sees only one pending tick, as with time.Ticker.
+	f.Advance(3 * time.Second)
+	if v := <-tk.C(); v != epoch.Add(1*time.Second) {
+		t.Fatalf("unexpected tick: %v", v)
+	}
+	select {
+	case v := <-tk.C():
+		t.Fatalf("ticks were queued: %v", v)
+	default:
+	}
+
+	f.Advance(1 * time.Second)
+	if v := <-tk.C(); v != epoch.Add(4*time.Second) {
+		t.Fatalf("unexpected tick: %v", v)
+	}
+
+	tk.Reset(10 * time.Second)
+	f.Advance(9 * time.Second)
+	select {
+	case v := <-tk.C():
+		t.Fatalf("tick before reset period elapsed: %v", v)
+	default:
+	}
+	f.Advance(1 * time.Second)
+	if v := <-tk.C(); v != epoch.Add(14*time.Second) {
+		t.Fatalf("unexpected tick: %v", v)
+	}
+
+	tk.Stop()
+	if len(f.PendingSleepers()) != 0 {
+		t.Fatalf("stopped ticker still registered")
+	}
+}
+
+func TestScaled(t *testing.T) {
+	f := NewSlowAt(epoch)
+	c := NewScaled(f, 60)
+
+	ch := c.After(time.Hour)
+	tk := c.NewTicker(30 * time.Minute)
+	f.Advance(30 * time.Second)
+	if v := <-tk.C(); v != epoch.Add(30*time.Minute) {
+		t.Fatalf("unexpected tick: %v", v)
+	}
+
+	f.Advance(30 * time.Second)
+	if v := <-ch; v != epoch.Add(time.Hour) {
+		t.Fatalf("unexpected time: %v", v)
+	}
+	if v := <-tk.C(); v != epoch.Add(time.Hour) {
+		t.Fatalf("unexpected tick: %v", v)
+	}
+
+	tk.Stop()
+	if c.Now() != epoch.Add(time.Hour) {
+		t.Fatalf("unexpected scaled time: %v", c.Now())
+	}
+}
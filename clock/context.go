@@ -0,0 +1,88 @@
+package clock
+
+import (
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+// Like context.WithDeadline, but the deadline is measured against the given
+// clock. With a fake clock, the returned context is only cancelled due to the
+// deadline once the fake time passes it.
+func WithDeadline(parent context.Context, clock Clock, deadline time.Time) (context.Context, context.CancelFunc) {
+	if clock == nil || clock == Real {
+		return context.WithDeadline(parent, deadline)
+	}
+
+	if cur, ok := parent.Deadline(); ok && cur.Before(deadline) {
+		// The current deadline is already sooner than the new one.
+		return context.WithCancel(parent)
+	}
+
+	cctx, cancel := context.WithCancel(parent)
+	c := &clockCtx{
+		Context:  cctx,
+		deadline: deadline,
+	}
+
+	d := deadline.Sub(clock.Now())
+	if d <= 0 {
+		c.expire(cancel)
+		return c, cancel
+	}
+
+	c.timer = clock.AfterFunc(d, func() {
+		c.expire(cancel)
+	})
+
+	return c, func() {
+		c.timer.Stop()
+		cancel()
+	}
+}
+
+// Like context.WithTimeout, but the timeout is measured against the given
+// clock. Equivalent to WithDeadline(parent, clock, clock.Now().Add(timeout)).
+func WithTimeout(parent context.Context, clock Clock, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if clock == nil {
+		clock = Real
+	}
+
+	return WithDeadline(parent, clock, clock.Now().Add(timeout))
+}
+
+// A context which is cancelled when a timer on a clock fires.
+type clockCtx struct {
+	context.Context
+	deadline time.Time
+	timer    Timer
+	mutex    sync.Mutex
+	err      error
+}
+
+func (c *clockCtx) expire(cancel context.CancelFunc) {
+	c.mutex.Lock()
+	if c.Context.Err() == nil {
+		c.err = context.DeadlineExceeded
+	}
+	c.mutex.Unlock()
+	cancel()
+}
+
+func (c *clockCtx) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func (c *clockCtx) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+
+	return c.Context.Err()
+}
+
+func (c *clockCtx) String() string {
+	return "clock.WithDeadline(" + c.deadline.String() + ")"
+}
@@ -0,0 +1,158 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Creates a clock which runs factor times faster than base. For example, with
+// a factor of 60, an hour passes on the returned clock for each minute which
+// passes on base. The returned clock initially reads the same time as base.
+//
+// All waiting operations, including timers and tickers, are scaled, so code
+// which uses long delays can be soak-tested in real time without having to
+// call Advance.
+func NewScaled(base Clock, factor float64) Clock {
+	if base == nil {
+		base = Real
+	}
+	if factor <= 0 {
+		panic("non-positive factor for NewScaled")
+	}
+
+	t := base.Now()
+	return &scaledClock{
+		base:      base,
+		factor:    factor,
+		start:     t,
+		baseStart: t,
+	}
+}
+
+type scaledClock struct {
+	base      Clock
+	factor    float64
+	start     time.Time
+	baseStart time.Time
+}
+
+// Converts a duration on the scaled clock to a duration on the base clock.
+func (c *scaledClock) toBase(d time.Duration) time.Duration {
+	return time.Duration(float64(d) / c.factor)
+}
+
+func (c *scaledClock) Now() time.Time {
+	elapsed := c.base.Now().Sub(c.baseStart)
+	return c.start.Add(time.Duration(float64(elapsed) * c.factor))
+}
+
+func (c *scaledClock) Sleep(d time.Duration) {
+	c.base.Sleep(c.toBase(d))
+}
+
+func (c *scaledClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *scaledClock) AfterFunc(d time.Duration, f func()) Timer {
+	return &scaledTimer{
+		clock: c,
+		t:     c.base.AfterFunc(c.toBase(d), f),
+	}
+}
+
+func (c *scaledClock) NewTimer(d time.Duration) Timer {
+	st := &scaledTimer{
+		clock: c,
+		c:     make(chan time.Time, 1),
+	}
+	st.t = c.base.AfterFunc(c.toBase(d), st.fire)
+	return st
+}
+
+func (c *scaledClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	st := &scaledTicker{
+		clock:  c,
+		c:      make(chan time.Time, 1),
+		period: d,
+	}
+
+	// fire may be called before AfterFunc returns.
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.t = c.base.AfterFunc(c.toBase(d), st.fire)
+	return st
+}
+
+// A timer on a scaled clock. The channel, if any, is fed from an AfterFunc on
+// the base clock so that the delivered time is the scaled time.
+type scaledTimer struct {
+	clock *scaledClock
+	c     chan time.Time
+	t     Timer
+}
+
+func (st *scaledTimer) fire() {
+	trySend(st.c, st.clock.Now())
+}
+
+func (st *scaledTimer) C() <-chan time.Time {
+	return st.c
+}
+
+func (st *scaledTimer) Stop() bool {
+	return st.t.Stop()
+}
+
+func (st *scaledTimer) Reset(d time.Duration) bool {
+	return st.t.Reset(st.clock.toBase(d))
+}
+
+// A ticker on a scaled clock, implemented as a base clock timer which is
+// rearmed each time it fires.
+type scaledTicker struct {
+	clock   *scaledClock
+	c       chan time.Time
+	t       Timer
+	mutex   sync.Mutex
+	period  time.Duration
+	stopped bool
+}
+
+func (st *scaledTicker) fire() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.stopped {
+		return
+	}
+
+	trySend(st.c, st.clock.Now())
+	st.t.Reset(st.clock.toBase(st.period))
+}
+
+func (st *scaledTicker) C() <-chan time.Time {
+	return st.c
+}
+
+func (st *scaledTicker) Stop() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.stopped = true
+	st.t.Stop()
+}
+
+func (st *scaledTicker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("non-positive interval for Ticker.Reset")
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.stopped = false
+	st.period = d
+	st.t.Reset(st.clock.toBase(d))
+}
@@ -0,0 +1,166 @@
+package health
+
+import "github.com/hlandau/degoutils/clock"
+import "golang.org/x/net/context"
+import "fmt"
+import "sync"
+import "time"
+
+// A Check is a criterion driven by a probe function which is called
+// periodically. The criterion is good while the most recent probe succeeded,
+// and its status is the error returned by the most recent probe.
+type Check struct {
+	criterion *Criterion
+	clock     clock.Clock
+	interval  time.Duration
+	timeout   time.Duration
+	probe     func(ctx context.Context) error
+
+	mutex   sync.Mutex
+	ok      bool
+	lastErr error
+	lastRun time.Time
+	timer   clock.Timer
+	cancel  context.CancelFunc
+	stopped bool
+}
+
+// Registers a check in the default registry. See Registry.RegisterCheck.
+func RegisterCheck(name string, interval, timeout time.Duration, probe func(ctx context.Context) error) *Check {
+	return Default.RegisterCheck(name, interval, timeout, probe)
+}
+
+// Creates a criterion with the given name which is driven by calling probe.
+// The probe is called immediately, and then interval after each call returns.
+// The context passed to probe is cancelled after timeout; if the probe has not
+// returned by then, it is considered to have failed. If timeout is zero, the
+// interval is used. Panics if interval is not positive.
+//
+// The criterion is initially bad, and becomes good once a probe succeeds. Each
+// probe is a sample for the purposes of Criterion.SetHysteresis.
+func (r *Registry) RegisterCheck(name string, interval, timeout time.Duration, probe func(ctx context.Context) error) *Check {
+	if interval <= 0 {
+		panic("non-positive interval for RegisterCheck")
+	}
+	if timeout == 0 {
+		timeout = interval
+	}
+
+	clk := r.Clock
+	if clk == nil {
+		clk = clock.Real
+	}
+
+	chk := &Check{
+		criterion: r.NewCriterion(name, false),
+		clock:     clk,
+		interval:  interval,
+		timeout:   timeout,
+		probe:     probe,
+	}
+	chk.criterion.SetStatus("not yet checked")
+
+	// Hold the lock so the first run can't begin until timer is set.
+	chk.mutex.Lock()
+	defer chk.mutex.Unlock()
+	chk.timer = clk.AfterFunc(0, chk.startRun)
+	return chk
+}
+
+func (chk *Check) startRun() {
+	go chk.run()
+}
+
+func (chk *Check) run() {
+	chk.mutex.Lock()
+	if chk.stopped {
+		chk.mutex.Unlock()
+		return
+	}
+
+	ctx, cancel := clock.WithTimeout(context.Background(), chk.clock, chk.timeout)
+	chk.cancel = cancel
+	startTime := chk.clock.Now()
+	chk.mutex.Unlock()
+
+	err := chk.callProbe(ctx)
+	cancel()
+
+	chk.mutex.Lock()
+	defer chk.mutex.Unlock()
+
+	chk.lastRun = startTime
+	chk.lastErr = err
+	if err == nil {
+		chk.criterion.SetStatus("")
+		if !chk.ok {
+			chk.ok = true
+			chk.criterion.Inc()
+		} else {
+			chk.criterion.Sample()
+		}
+	} else {
+		chk.criterion.SetStatus(err.Error())
+		if chk.ok {
+			chk.ok = false
+			chk.criterion.Dec()
+		} else {
+			chk.criterion.Sample()
+		}
+	}
+
+	if !chk.stopped {
+		chk.timer.Reset(chk.interval)
+	}
+}
+
+// Calls the probe, giving up when the context expires even if the probe does
+// not return.
+func (chk *Check) callProbe(ctx context.Context) (err error) {
+	errChan := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errChan <- fmt.Errorf("probe panicked: %v", r)
+			}
+		}()
+
+		errChan <- chk.probe(ctx)
+	}()
+
+	select {
+	case err = <-errChan:
+		return
+	case <-ctx.Done():
+		return fmt.Errorf("probe timed out: %v", ctx.Err())
+	}
+}
+
+// Returns the criterion driven by the check.
+func (chk *Check) Criterion() *Criterion {
+	return chk.criterion
+}
+
+// Returns the error returned by the most recent probe, and the time at which
+// it was started. The time is zero if the probe has not yet completed.
+func (chk *Check) LastResult() (time.Time, error) {
+	chk.mutex.Lock()
+	defer chk.mutex.Unlock()
+	return chk.lastRun, chk.lastErr
+}
+
+// Stops calling the probe and removes the criterion from the registry, so
+// that a stopped check no longer affects its health. A probe in progress has
+// its context cancelled.
+func (chk *Check) Stop() {
+	defer chk.criterion.Close()
+
+	chk.mutex.Lock()
+	defer chk.mutex.Unlock()
+
+	chk.stopped = true
+	chk.timer.Stop()
+	if chk.cancel != nil {
+		chk.cancel()
+	}
+}
@@ -4,9 +4,16 @@
 // in good health if all criterions have positive counts. Otherwise,
 // the process is in bad health. The internal implementation uses refcounting.
 //
-// The health of the process can be queried at /health on the default
-// HTTP serve mux. This returns 200 or 503. /health/info provides more detailed
-// info about bad criterions.
+// Criteria belong to a Registry. The package-level functions use the Default
+// registry, which can be queried at /health on the default HTTP serve mux.
+// This returns 200 or 503. /health/info provides more detailed info about bad
+// criterions, or about all criterions in JSON form if "?format=json" is
+// appended.
+//
+// Each criterion counts toward one or more probe classes. /health/live,
+// /health/ready and /health/startup consider only the criteria of the
+// corresponding class, so that an orchestrator can distinguish a process which
+// must be restarted from one which is merely not ready yet.
 package health
 
 import "net/http"
@@ -14,59 +21,410 @@ import "sync"
 import "sync/atomic"
 import "fmt"
 import "bytes"
+import "sort"
+import "strings"
+import "encoding/json"
+import "time"
+import "github.com/hlandau/degoutils/clock"
+
+// A registry is a set of criteria which together determine the health of a
+// component. The zero value is an empty registry ready for use.
+type Registry struct {
+	// The clock used to schedule checks registered with RegisterCheck. Defaults
+	// to clock.Real. Must be set before any checks are registered.
+	Clock clock.Clock
+
+	// If non-empty, the criteria in the registry are included under this prefix
+	// in the samples returned by Metrics. Criteria with the same name in
+	// registries with the same prefix are combined. Must be set before any
+	// criteria are created. The default registry uses the prefix "health.".
+	MetricPrefix string
+
+	badCriteriaCount uint64
+	badProbeCount    [numProbes]uint64
+	criteria         map[*Criterion]struct{}
+	badCriteria      map[*Criterion]struct{}
+	mutex            sync.RWMutex
+}
+
+// The registry used by the package-level functions and served on the default
+// HTTP serve mux.
+var Default = &Registry{
+	MetricPrefix: "health.",
+}
+
+// Create a new, empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// A probe class, or a set of probe classes.
+type Probe int
 
-var badCriteriaCount uint64
-var badCriteria = map[*Criterion]struct{}{}
-var badCriteriaMutex sync.RWMutex
+const (
+	// Liveness criteria determine whether the process is functioning at all. A
+	// process which fails its liveness probe should be restarted.
+	Liveness Probe = 1 << iota
+
+	// Readiness criteria determine whether the process can currently serve
+	// requests.
+	Readiness
+
+	// Startup criteria determine whether the process has finished starting.
+	Startup
+
+	// All probe classes. This is the class of criteria created by NewCriterion.
+	AllProbes = Liveness | Readiness | Startup
+
+	numProbes = 3
+)
+
+var probeNames = [numProbes]string{"liveness", "readiness", "startup"}
+
+// Returns the names of the probe classes in the set, separated by commas.
+func (p Probe) String() string {
+	return strings.Join(p.names(), ",")
+}
+
+func (p Probe) names() []string {
+	names := []string{}
+	for i := uint(0); i < numProbes; i++ {
+		if p&(1<<i) != 0 {
+			names = append(names, probeNames[i])
+		}
+	}
+	return names
+}
+
+// Parses a probe class name such as "readiness". "live", "ready" and "all"
+// are also accepted.
+func ParseProbe(s string) (Probe, error) {
+	switch s {
+	case "liveness", "live":
+		return Liveness, nil
+	case "readiness", "ready":
+		return Readiness, nil
+	case "startup":
+		return Startup, nil
+	case "all":
+		return AllProbes, nil
+	default:
+		return 0, fmt.Errorf("unknown probe class: %#v", s)
+	}
+}
 
 type Criterion struct {
-	name   string
-	status string
-	value  int64
+	name     string
+	probes   Probe
+	registry *Registry
+	value    int64 // atomic; written only with mutex held
+
+	mutex       sync.Mutex
+	status      string
+	bad         bool      // the reported state, which lags value under hysteresis
+	since       time.Time // time of the last transition, or of creation
+	history     []Transition
+	transitions uint64
+	badSamples  int
+	goodSamples int
+	streak      int  // consecutive samples disagreeing with the reported state
+	removed     bool // removed from the registry
 }
 
-// Create a new criterion. If ok is true, the initial counter value
-// is 1; otherwise, it is 0.
+// The number of transitions retained by each criterion.
+const HistoryLength = 16
+
+// A change in the reported state of a criterion.
+type Transition struct {
+	Time   time.Time
+	OK     bool
+	Value  int
+	Status string
+}
+
+// Create a new criterion in the default registry. If ok is true, the initial
+// counter value is 1; otherwise, it is 0. The criterion counts toward all
+// probe classes.
 func NewCriterion(name string, ok bool) *Criterion {
+	return Default.NewCriterion(name, ok)
+}
+
+// Create a new criterion in the default registry which counts only toward the
+// given probe classes.
+func NewProbeCriterion(name string, ok bool, probes Probe) *Criterion {
+	return Default.NewProbeCriterion(name, ok, probes)
+}
+
+// Create a new criterion in the registry. If ok is true, the initial counter
+// value is 1; otherwise, it is 0. The criterion counts toward all probe
+// classes.
+func (r *Registry) NewCriterion(name string, ok bool) *Criterion {
+	return r.NewProbeCriterion(name, ok, AllProbes)
+}
+
+// Create a new criterion in the registry which counts only toward the given
+// probe classes.
+func (r *Registry) NewProbeCriterion(name string, ok bool, probes Probe) *Criterion {
 	c := &Criterion{
-		name:  name,
-		value: 1,
+		name:        name,
+		value:       1,
+		probes:      probes & AllProbes,
+		registry:    r,
+		since:       r.getClock().Now(),
+		badSamples:  1,
+		goodSamples: 1,
 	}
+
 	if !ok {
-		c.Dec()
+		c.value = 0
+		c.bad = true
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.criteria == nil {
+		r.criteria = map[*Criterion]struct{}{}
+	}
+	r.criteria[c] = struct{}{}
+	r.lSetExported(true)
+	if c.bad {
+		r.lUpdateBad(c, true)
 	}
 	return c
 }
 
+// Removes a criterion from the registry, so that it no longer affects the
+// health of the registry and is no longer listed. Criteria which are no
+// longer needed should be removed, as the registry otherwise retains them
+// forever. Changes made to the criterion after it has been removed are
+// ignored. Does nothing if the criterion has already been removed.
+func (r *Registry) Remove(c *Criterion) {
+	if c.registry != r {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.removed {
+		return
+	}
+	c.removed = true
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.criteria, c)
+	if len(r.criteria) == 0 {
+		r.lSetExported(false)
+	}
+	if c.bad {
+		r.lUpdateBad(c, false)
+	}
+}
+
+func (r *Registry) getClock() clock.Clock {
+	if r.Clock == nil {
+		return clock.Real
+	}
+	return r.Clock
+}
+
+// Updates the registry after c has gone bad or good, or after a bad criterion
+// has been removed. Lock must be held.
+func (r *Registry) lUpdateBad(c *Criterion, bad bool) {
+	delta := uint64(1)
+	if bad {
+		// gone bad
+		if r.badCriteria == nil {
+			r.badCriteria = map[*Criterion]struct{}{}
+		}
+		r.badCriteria[c] = struct{}{}
+	} else {
+		// gone good, or removed
+		delete(r.badCriteria, c)
+		delta = ^uint64(0) // decrement
+	}
+
+	atomic.AddUint64(&r.badCriteriaCount, delta)
+	for i := uint(0); i < numProbes; i++ {
+		if c.probes&(1<<i) != 0 {
+			atomic.AddUint64(&r.badProbeCount[i], delta)
+		}
+	}
+}
+
+// Returns true if the registry has no bad criteria.
+func (r *Registry) OK() bool {
+	return atomic.LoadUint64(&r.badCriteriaCount) == 0
+}
+
+// Returns true if the registry has no bad criteria counting toward any of the
+// given probe classes.
+func (r *Registry) ProbeOK(probes Probe) bool {
+	for i := uint(0); i < numProbes; i++ {
+		if probes&(1<<i) != 0 && atomic.LoadUint64(&r.badProbeCount[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns all criteria in the registry, sorted by name.
+func (r *Registry) Criteria() []*Criterion {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return sortedCriteria(r.criteria)
+}
+
+// Returns the bad criteria in the registry, sorted by name.
+func (r *Registry) BadCriteria() []*Criterion {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return sortedCriteria(r.badCriteria)
+}
+
+func sortedCriteria(m map[*Criterion]struct{}) []*Criterion {
+	cs := make([]*Criterion, 0, len(m))
+	for c := range m {
+		cs = append(cs, c)
+	}
+
+	sort.Sort(byName(cs))
+	return cs
+}
+
+type byName []*Criterion
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].name < a[j].name }
+
 // A descriptive string representing the criterion.
 func (c *Criterion) String() string {
-	return fmt.Sprintf("criterion \"%s\": %v: %s", c.name, c.value, c.status)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	state := "good"
+	if c.bad {
+		state = "bad"
+	}
+
+	return fmt.Sprintf("criterion \"%s\": %v: %s (%s since %s, %d transitions)", c.name,
+		c.Value(), c.status, state, c.since.UTC().Format(time.RFC3339), c.transitions)
 }
 
 // Add to the criterion counter. If the resulting count is positive,
 // the criterion is in good health.
+//
+// Each call is also a sample of the criterion's health for the purposes of
+// hysteresis (see SetHysteresis). Add(0) records a sample without changing
+// the counter.
 func (c *Criterion) Add(x int) {
-	oldValue := atomic.LoadInt64(&c.value)
-	newValue := oldValue + int64(x)
-	oldValueIsBad := oldValue <= 0
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	newValue := atomic.AddInt64(&c.value, int64(x))
 	newValueIsBad := newValue <= 0
+	if newValueIsBad == c.bad {
+		c.streak = 0
+		return
+	}
 
-	if !atomic.CompareAndSwapInt64(&c.value, oldValue, newValue) {
-		c.Add(x)
-	} else if oldValueIsBad != newValueIsBad {
-		badCriteriaMutex.Lock()
-		defer badCriteriaMutex.Unlock()
+	c.streak++
+	needed := c.goodSamples
+	if newValueIsBad {
+		needed = c.badSamples
+	}
+	if c.streak < needed {
+		return
+	}
 
-		if newValueIsBad {
-			// gone bad
-			badCriteria[c] = struct{}{}
-			atomic.AddUint64(&badCriteriaCount, 1)
-		} else {
-			// gone good
-			delete(badCriteria, c)
-			atomic.AddUint64(&badCriteriaCount, ^uint64(0)) // decrement
-		}
+	c.streak = 0
+	c.bad = newValueIsBad
+	c.lTransition(int(newValue))
+}
+
+// Records a transition in the reported state. Lock must be held.
+func (c *Criterion) lTransition(value int) {
+	c.since = c.registry.getClock().Now()
+	c.transitions++
+	if len(c.history) >= HistoryLength {
+		c.history = append(c.history[:0], c.history[1:]...)
+	}
+	c.history = append(c.history, Transition{
+		Time:   c.since,
+		OK:     !c.bad,
+		Value:  value,
+		Status: c.status,
+	})
+
+	if c.removed {
+		return
 	}
+
+	r := c.registry
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lUpdateBad(c, c.bad)
+}
+
+// Records a sample of the criterion's health without changing the counter.
+// Equivalent to Add(0).
+func (c *Criterion) Sample() {
+	c.Add(0)
+}
+
+// Configures flap damping. The criterion is only reported as bad once the
+// counter has been non-positive for badSamples consecutive samples, and only
+// reported as good again once it has been positive for goodSamples
+// consecutive samples. Each call to Add, Sub, Inc, Dec or Sample is a sample.
+//
+// The default for both is 1, meaning that the reported state follows the
+// counter immediately.
+func (c *Criterion) SetHysteresis(badSamples, goodSamples int) {
+	if badSamples < 1 {
+		badSamples = 1
+	}
+	if goodSamples < 1 {
+		goodSamples = 1
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.badSamples = badSamples
+	c.goodSamples = goodSamples
+	c.streak = 0
+}
+
+// Returns the time of the last transition between good and bad health, or
+// the time at which the criterion was created if there has been none.
+func (c *Criterion) LastTransition() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.since
+}
+
+// Returns the number of transitions between good and bad health since the
+// criterion was created.
+func (c *Criterion) TransitionCount() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.transitions
+}
+
+// Returns the most recent transitions, oldest first. At most HistoryLength
+// transitions are retained.
+func (c *Criterion) History() []Transition {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	h := make([]Transition, len(c.history))
+	copy(h, c.history)
+	return h
 }
 
 // Subtract from the criterion counter. If the resulting count is not
@@ -93,53 +451,203 @@ func (c *Criterion) Name() string {
 // Set the criterion status. This is a freeform string which
 // you may optionally use to describe the current criterion status.
 func (c *Criterion) SetStatus(status string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	c.status = status
 }
 
 // Return the current criterion status. The default status is the empty
 // string.
 func (c *Criterion) Status() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.status
 }
 
 // Return the criterion counter. If the counter is positive, the criterion
 // is in good health.
 func (c *Criterion) Value() int {
-	return int(c.value)
+	return int(atomic.LoadInt64(&c.value))
+}
+
+// Returns true if the criterion is in good health. This normally means that
+// the counter is positive, but lags it if hysteresis is configured.
+func (c *Criterion) OK() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return !c.bad
+}
+
+// Removes the criterion from its registry. Equivalent to calling Remove on the
+// registry.
+func (c *Criterion) Close() {
+	c.registry.Remove(c)
+}
+
+// Returns the probe classes the criterion counts toward.
+func (c *Criterion) Probes() Probe {
+	return c.probes
 }
 
 func init() {
-	http.HandleFunc("/health", handler)
-	http.HandleFunc("/health/info", detailedHandler)
+	http.Handle("/health", Default.Handler())
+	http.Handle("/health/live", Default.ProbeHandler(Liveness))
+	http.Handle("/health/ready", Default.ProbeHandler(Readiness))
+	http.Handle("/health/startup", Default.ProbeHandler(Startup))
+	http.Handle("/health/info", Default.InfoHandler())
 }
 
 var okResponse = []byte{'O', 'K'}
 var errResponse = []byte{'E', 'R', 'R'}
 
-func handler(rw http.ResponseWriter, req *http.Request) {
-	bc := atomic.LoadUint64(&badCriteriaCount)
-	if bc > 0 {
-		rw.WriteHeader(503)
-		rw.Write(errResponse)
-	} else {
-		rw.Write(okResponse)
+// Returns a handler which responds with "OK" if the registry is in good
+// health, or 503 and "ERR" otherwise.
+func (r *Registry) Handler() http.Handler {
+	return r.ProbeHandler(AllProbes)
+}
+
+// Returns a handler which responds with "OK" if no criterion counting toward
+// the given probe classes is bad, or 503 and "ERR" otherwise.
+func (r *Registry) ProbeHandler(probes Probe) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !r.ProbeOK(probes) {
+			rw.WriteHeader(503)
+			rw.Write(errResponse)
+		} else {
+			rw.Write(okResponse)
+		}
+	})
+}
+
+// Returns a handler which describes the bad criteria in the registry in plain
+// text, including when each last changed state. If the request has the query
+// parameter "format=json" or accepts application/json, all criteria are
+// described in JSON form instead, together with their transition history. The
+// status code is 503 if the registry is in bad health.
+//
+// If the query parameter "probe" names a probe class, only criteria counting
+// toward that class are considered.
+func (r *Registry) InfoHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		probes := AllProbes
+		if ps := req.URL.Query().Get("probe"); ps != "" {
+			var err error
+			probes, err = ParseProbe(ps)
+			if err != nil {
+				http.Error(rw, err.Error(), 400)
+				return
+			}
+		}
+
+		if wantsJSON(req) {
+			r.jsonInfo(rw, probes)
+		} else {
+			r.textInfo(rw, probes)
+		}
+	})
+}
+
+func filterProbes(cs []*Criterion, probes Probe) []*Criterion {
+	var cs2 []*Criterion
+	for _, c := range cs {
+		if c.probes&probes != 0 {
+			cs2 = append(cs2, c)
+		}
 	}
+	return cs2
 }
 
-func detailedHandler(rw http.ResponseWriter, req *http.Request) {
-	badCriteriaMutex.RLock()
-	defer badCriteriaMutex.RUnlock()
+func wantsJSON(req *http.Request) bool {
+	return req.URL.Query().Get("format") == "json" ||
+		strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+func (r *Registry) textInfo(rw http.ResponseWriter, probes Probe) {
+	bad := filterProbes(r.BadCriteria(), probes)
 
 	var buf bytes.Buffer
-	if len(badCriteria) > 0 {
+	if len(bad) > 0 {
 		rw.WriteHeader(503)
-		fmt.Fprintf(&buf, "ERR %v\n", len(badCriteria))
+		fmt.Fprintf(&buf, "ERR %v\n", len(bad))
 	} else {
 		buf.WriteString("OK\n")
 	}
 
-	for c := range badCriteria {
+	for _, c := range bad {
 		fmt.Fprintf(&buf, "%s\n", c.String())
 	}
 	rw.Write(buf.Bytes())
 }
+
+type jsonCriterion struct {
+	Name   string   `json:"name"`
+	Value  int      `json:"value"`
+	OK     bool     `json:"ok"`
+	Status string   `json:"status"`
+	Probes []string `json:"probes"`
+	Since  string   `json:"since"`
+
+	Transitions uint64           `json:"transitions"`
+	History     []jsonTransition `json:"history"`
+}
+
+type jsonTransition struct {
+	Time   string `json:"time"`
+	OK     bool   `json:"ok"`
+	Value  int    `json:"value"`
+	Status string `json:"status"`
+}
+
+type jsonInfo struct {
+	OK       bool            `json:"ok"`
+	Bad      int             `json:"bad"`
+	Criteria []jsonCriterion `json:"criteria"`
+}
+
+func (r *Registry) jsonInfo(rw http.ResponseWriter, probes Probe) {
+	info := jsonInfo{
+		Criteria: []jsonCriterion{},
+	}
+
+	for _, c := range filterProbes(r.Criteria(), probes) {
+		c.mutex.Lock()
+		jc := jsonCriterion{
+			Name:        c.name,
+			Value:       c.Value(),
+			OK:          !c.bad,
+			Status:      c.status,
+			Probes:      c.probes.names(),
+			Since:       c.since.UTC().Format(time.RFC3339Nano),
+			Transitions: c.transitions,
+			History:     []jsonTransition{},
+		}
+		for _, t := range c.history {
+			jc.History = append(jc.History, jsonTransition{
+				Time:   t.Time.UTC().Format(time.RFC3339Nano),
+				OK:     t.OK,
+				Value:  t.Value,
+				Status: t.Status,
+			})
+		}
+		c.mutex.Unlock()
+
+		if !jc.OK {
+			info.Bad++
+		}
+		info.Criteria = append(info.Criteria, jc)
+	}
+
+	info.OK = info.Bad == 0
+
+	b, err := json.Marshal(&info)
+	if err != nil {
+		rw.WriteHeader(500)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if !info.OK {
+		rw.WriteHeader(503)
+	}
+	rw.Write(b)
+}
@@ -0,0 +1,268 @@
+package health
+
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "encoding/json"
+import "fmt"
+import "time"
+import "github.com/hlandau/degoutils/clock"
+import "golang.org/x/net/context"
+
+func get(h http.Handler, url string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	a := r.NewCriterion("a", true)
+	b := r.NewCriterion("b", false)
+	b.SetStatus("starting")
+
+	if rw := get(r.Handler(), "/health"); rw.Code != 503 || rw.Body.String() != "ERR" {
+		t.Fatalf("unexpected response: %v %q", rw.Code, rw.Body.String())
+	}
+
+	rw := get(r.InfoHandler(), "/health/info?format=json")
+	if rw.Code != 503 {
+		t.Fatalf("unexpected status code: %v", rw.Code)
+	}
+
+	var info jsonInfo
+	err := json.Unmarshal(rw.Body.Bytes(), &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.OK || info.Bad != 1 || len(info.Criteria) != 2 ||
+		info.Criteria[0].Name != "a" || !info.Criteria[0].OK ||
+		info.Criteria[1].Name != "b" || info.Criteria[1].OK || info.Criteria[1].Status != "starting" ||
+		len(info.Criteria[1].Probes) != 3 {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+
+	b.Inc()
+	a.Inc()
+	if rw := get(r.Handler(), "/health"); rw.Code != 200 || rw.Body.String() != "OK" {
+		t.Fatalf("unexpected response: %v %q", rw.Code, rw.Body.String())
+	}
+	if rw := get(r.InfoHandler(), "/health/info"); rw.Code != 200 || rw.Body.String() != "OK\n" {
+		t.Fatalf("unexpected response: %v %q", rw.Code, rw.Body.String())
+	}
+
+	if !Default.OK() {
+		t.Fatalf("default registry affected by other registry")
+	}
+
+	b.Sub(2)
+	b.Close()
+	if !r.OK() || !r.ProbeOK(AllProbes) || len(r.Criteria()) != 1 || len(r.BadCriteria()) != 0 {
+		t.Fatalf("removed criterion still affects registry")
+	}
+
+	// Changes after removal are ignored.
+	b.Inc()
+	b.Dec()
+	r.Remove(b)
+	if !r.OK() || len(r.Criteria()) != 1 {
+		t.Fatalf("removed criterion still affects registry")
+	}
+}
+
+func TestProbes(t *testing.T) {
+	// The zero value is usable.
+	r := &Registry{}
+	ready := r.NewProbeCriterion("ready", false, Readiness)
+
+	if !r.ProbeOK(Liveness) || !r.ProbeOK(Startup) || r.ProbeOK(Readiness) || r.OK() {
+		t.Fatalf("unexpected probe state")
+	}
+	if rw := get(r.ProbeHandler(Liveness), "/health/live"); rw.Code != 200 {
+		t.Fatalf("liveness affected by readiness criterion")
+	}
+	if rw := get(r.ProbeHandler(Readiness), "/health/ready"); rw.Code != 503 {
+		t.Fatalf("readiness not affected by readiness criterion")
+	}
+	if rw := get(r.InfoHandler(), "/health/info?probe=live"); rw.Code != 200 || rw.Body.String() != "OK\n" {
+		t.Fatalf("unexpected response: %v %q", rw.Code, rw.Body.String())
+	}
+
+	ready.Inc()
+	if !r.ProbeOK(AllProbes) {
+		t.Fatalf("unexpected probe state")
+	}
+}
+
+func waitFor(f func() bool) {
+	for !f() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	clk := clock.NewSlowAt(time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := NewRegistry()
+	r.Clock = clk
+
+	results := make(chan error)
+	chk := r.RegisterCheck("db", 10*time.Second, 5*time.Second, func(ctx context.Context) error {
+		select {
+		case err := <-results:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	c := chk.Criterion()
+	if c.OK() {
+		t.Fatalf("check good before first probe")
+	}
+
+	// waits until the next probe has been scheduled
+	idle := func() bool {
+		ps := clk.PendingSleepers()
+		return len(ps) == 1 && ps[0].Equal(clk.Now().Add(10*time.Second))
+	}
+
+	results <- nil
+	waitFor(c.OK)
+	waitFor(idle)
+
+	clk.Advance(10 * time.Second)
+	results <- fmt.Errorf("connection refused")
+	waitFor(func() bool { return !c.OK() })
+	waitFor(idle)
+	if c.Status() != "connection refused" {
+		t.Fatalf("unexpected status: %q", c.Status())
+	}
+
+	clk.Advance(10 * time.Second)
+	clk.BlockUntil(1)
+	clk.Advance(5 * time.Second)
+	waitFor(idle)
+	if _, err := chk.LastResult(); err == nil || c.OK() {
+		t.Fatalf("probe did not time out")
+	}
+
+	chk.Stop()
+	if len(clk.PendingSleepers()) != 0 {
+		t.Fatalf("stopped check still scheduled")
+	}
+	if !r.OK() || len(r.Criteria()) != 0 {
+		t.Fatalf("stopped check still affects registry")
+	}
+}
+
+func TestCheckInterval(t *testing.T) {
+	r := NewRegistry()
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("zero interval accepted")
+		}
+		if len(r.Criteria()) != 0 {
+			t.Fatalf("criterion created for rejected check")
+		}
+	}()
+
+	r.RegisterCheck("zero", 0, time.Second, func(ctx context.Context) error {
+		return nil
+	})
+}
+
+func TestHysteresis(t *testing.T) {
+	epoch := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewSlowAt(epoch)
+	r := NewRegistry()
+	r.Clock = clk
+
+	c := r.NewCriterion("flappy", true)
+	c.SetHysteresis(3, 2)
+
+	clk.Advance(time.Second)
+	c.Dec()
+	c.Sample()
+	if !c.OK() || !r.OK() {
+		t.Fatalf("went bad too early")
+	}
+
+	clk.Advance(time.Second)
+	c.Sample()
+	if c.OK() || r.OK() {
+		t.Fatalf("did not go bad after 3 samples")
+	}
+
+	// An isolated good sample does not recover the criterion.
+	c.Inc()
+	c.Dec()
+	c.Inc()
+	if c.OK() {
+		t.Fatalf("recovered too early")
+	}
+
+	clk.Advance(time.Second)
+	c.Sample()
+	if !c.OK() || !r.OK() {
+		t.Fatalf("did not recover after 2 samples")
+	}
+
+	h := c.History()
+	if len(h) != 2 || h[0].OK || !h[0].Time.Equal(epoch.Add(2*time.Second)) ||
+		!h[1].OK || !h[1].Time.Equal(epoch.Add(3*time.Second)) {
+		t.Fatalf("unexpected history: %+v", h)
+	}
+	if !c.LastTransition().Equal(epoch.Add(3 * time.Second)) {
+		t.Fatalf("unexpected last transition: %v", c.LastTransition())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	r := NewRegistry()
+	r.MetricPrefix = "test."
+	c := r.NewCriterion("metric", false)
+	c.Add(2)
+	c.Dec()
+	c.Dec()
+	if c.TransitionCount() != 2 {
+		t.Fatalf("unexpected transition count: %v", c.TransitionCount())
+	}
+
+	// Names need not be unique or valid metric names.
+	r2 := NewRegistry()
+	r2.MetricPrefix = "test."
+	d1 := r2.NewCriterion("with space", true)
+	d2 := r2.NewCriterion("with space", false)
+	u := NewRegistry().NewCriterion("unexported", true)
+
+	ms := testMetrics()
+	if len(ms) != 2 || ms[0] != (Metric{"test.", "metric", 0, false, 2}) || ms[1] != (Metric{"test.", "with space", 1, false, 0}) {
+		t.Fatalf("unexpected metrics: %+v", ms)
+	}
+
+	// Removed criteria are no longer exported.
+	c.Close()
+	d1.Close()
+	d2.Close()
+	u.Close()
+	if ms := testMetrics(); len(ms) != 0 {
+		t.Fatalf("unexpected metrics after removal: %+v", ms)
+	}
+}
+
+// Returns the metrics with the prefix used by TestMetrics.
+func testMetrics() []Metric {
+	var ms []Metric
+	for _, m := range Metrics() {
+		if m.Prefix == "test." {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
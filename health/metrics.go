@@ -0,0 +1,101 @@
+package health
+
+import "sort"
+import "sync"
+import "sync/atomic"
+
+// Criteria are exported by walking the exported registries when metrics are
+// collected, rather than by registering metrics for each criterion. Criteria
+// may therefore have any name, share names, and be created and removed
+// freely. This package does not export the metrics itself; see Metrics.
+
+// Registries which have a MetricPrefix and contain at least one criterion.
+var metricRegistries = struct {
+	mutex      sync.Mutex
+	registries map[*Registry]struct{}
+}{
+	registries: map[*Registry]struct{}{},
+}
+
+// Starts or stops exporting a registry. Registry lock must be held.
+func (r *Registry) lSetExported(exported bool) {
+	if r.MetricPrefix == "" {
+		return
+	}
+
+	metricRegistries.mutex.Lock()
+	defer metricRegistries.mutex.Unlock()
+
+	if exported {
+		metricRegistries.registries[r] = struct{}{}
+	} else {
+		delete(metricRegistries.registries, r)
+	}
+}
+
+// The metrics for the criteria of a given name in the registries with a given
+// prefix. Where several criteria share a name, their values and transition
+// counts are summed, and they are good only if all of them are good.
+type Metric struct {
+	Prefix      string
+	Name        string
+	Value       int64
+	OK          bool
+	Transitions uint64
+}
+
+// Samples the criteria of all registries which have a MetricPrefix, ordered by
+// prefix and name. This is intended to be called whenever metrics are
+// collected; the web package's metric policy uses it to export criteria via
+// expvar and Prometheus.
+func Metrics() []Metric {
+	metricRegistries.mutex.Lock()
+	var rs []*Registry
+	for r := range metricRegistries.registries {
+		rs = append(rs, r)
+	}
+	metricRegistries.mutex.Unlock()
+
+	type key struct{ prefix, name string }
+	samples := map[key]*Metric{}
+	for _, r := range rs {
+		for _, c := range r.Criteria() {
+			k := key{r.MetricPrefix, c.name}
+			m, ok := samples[k]
+			if !ok {
+				m = &Metric{Prefix: k.prefix, Name: k.name, OK: true}
+				samples[k] = m
+			}
+
+			c.mutex.Lock()
+			m.Value += atomic.LoadInt64(&c.value)
+			m.OK = m.OK && !c.bad
+			m.Transitions += c.transitions
+			c.mutex.Unlock()
+		}
+	}
+
+	ms := make([]Metric, 0, len(samples))
+	for _, m := range samples {
+		ms = append(ms, *m)
+	}
+	sort.Sort(metricSorter(ms))
+	return ms
+}
+
+type metricSorter []Metric
+
+func (ms metricSorter) Len() int {
+	return len(ms)
+}
+
+func (ms metricSorter) Less(i, j int) bool {
+	if ms[i].Prefix != ms[j].Prefix {
+		return ms[i].Prefix < ms[j].Prefix
+	}
+	return ms[i].Name < ms[j].Name
+}
+
+func (ms metricSorter) Swap(i, j int) {
+	ms[i], ms[j] = ms[j], ms[i]
+}
@@ -0,0 +1,237 @@
+// Package sdnotify implements the systemd service notification protocol and
+// derives readiness and watchdog notifications from a health registry.
+//
+// Notifications are datagrams of newline-separated VARIABLE=value assignments
+// sent to the unix socket named by the NOTIFY_SOCKET environment variable.
+package sdnotify
+
+import "github.com/hlandau/degoutils/clock"
+import "github.com/hlandau/degoutils/health"
+import "github.com/hlandau/xlog"
+import "fmt"
+import "net"
+import "os"
+import "strconv"
+import "strings"
+import "time"
+
+var log, Log = xlog.New("sdnotify")
+
+// Sends notifications to a service manager.
+type Notifier struct {
+	addr *net.UnixAddr
+}
+
+// Returns a notifier for the socket named by the NOTIFY_SOCKET environment
+// variable, or nil if it is not set (i.e., the process is not running under
+// a service manager which supports notification).
+func FromEnv() *Notifier {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	return New(path)
+}
+
+// Returns a notifier for the socket at the given path. A path beginning with
+// "@" denotes a socket in the abstract namespace.
+func New(path string) *Notifier {
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+
+	return &Notifier{
+		addr: &net.UnixAddr{Name: path, Net: "unixgram"},
+	}
+}
+
+// Sends a notification consisting of the given assignments, e.g. "READY=1".
+// Calling Notify on a nil notifier does nothing.
+func (n *Notifier) Notify(assignments ...string) error {
+	if n == nil {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, n.addr)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(assignments, "\n")))
+	return err
+}
+
+// Returns the watchdog interval requested by the service manager via the
+// WATCHDOG_USEC and WATCHDOG_PID environment variables, or 0 if the watchdog
+// is not enabled for this process.
+func WatchdogInterval() (time.Duration, error) {
+	usecs := os.Getenv("WATCHDOG_USEC")
+	if usecs == "" {
+		return 0, nil
+	}
+
+	if pids := os.Getenv("WATCHDOG_PID"); pids != "" {
+		pid, err := strconv.Atoi(pids)
+		if err != nil {
+			return 0, fmt.Errorf("invalid WATCHDOG_PID: %#v", pids)
+		}
+		if pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+
+	usec, err := strconv.ParseUint(usecs, 10, 63)
+	if err != nil || usec == 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC: %#v", usecs)
+	}
+
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// Monitor configuration.
+type Config struct {
+	// Where notifications are sent. If nil, FromEnv is used; if that returns
+	// nil, Start does nothing.
+	Notifier *Notifier
+
+	// The registry which determines readiness and health. Defaults to
+	// health.Default.
+	Registry *health.Registry
+
+	// READY=1 is sent once no criteria in these probe classes are bad. Defaults
+	// to health.AllProbes.
+	ReadyProbes health.Probe
+
+	// Watchdog pings are sent only while no criteria in these probe classes
+	// are bad. Defaults to health.Liveness.
+	WatchdogProbes health.Probe
+
+	// The watchdog interval. Pings are sent at half this interval. If zero,
+	// WatchdogInterval is used. If negative, no pings are sent.
+	WatchdogInterval time.Duration
+
+	// How often to check the registry for readiness. Defaults to one second.
+	PollInterval time.Duration
+
+	// Optional channel of status strings, e.g. web.Config.StatusChan(). Each
+	// string received is sent as STATUS=. When the channel is closed,
+	// STOPPING=1 is sent.
+	StatusChan <-chan string
+
+	// The clock used for polling and watchdog pings. Defaults to clock.Real.
+	Clock clock.Clock
+}
+
+// Sends notifications derived from a health registry until stopped.
+type Monitor struct {
+	cfg      Config
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+// Starts sending notifications in the background. Returns nil if there is no
+// service manager to notify.
+func Start(cfg Config) (*Monitor, error) {
+	if cfg.Notifier == nil {
+		cfg.Notifier = FromEnv()
+		if cfg.Notifier == nil {
+			return nil, nil
+		}
+	}
+	if cfg.Registry == nil {
+		cfg.Registry = health.Default
+	}
+	if cfg.ReadyProbes == 0 {
+		cfg.ReadyProbes = health.AllProbes
+	}
+	if cfg.WatchdogProbes == 0 {
+		cfg.WatchdogProbes = health.Liveness
+	}
+	if cfg.WatchdogInterval == 0 {
+		var err error
+		cfg.WatchdogInterval, err = WatchdogInterval()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = 1 * time.Second
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real
+	}
+
+	m := &Monitor{
+		cfg:      cfg,
+		stopChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+	}
+
+	go m.loop()
+	return m, nil
+}
+
+// Stops sending notifications. Calling Stop on a nil monitor does nothing.
+func (m *Monitor) Stop() {
+	if m == nil {
+		return
+	}
+
+	close(m.stopChan)
+	<-m.doneChan
+}
+
+func (m *Monitor) notify(assignments ...string) {
+	err := m.cfg.Notifier.Notify(assignments...)
+	log.Errore(err, "cannot send service notification")
+}
+
+func (m *Monitor) loop() {
+	defer close(m.doneChan)
+
+	pollTicker := m.cfg.Clock.NewTicker(m.cfg.PollInterval)
+	defer pollTicker.Stop()
+
+	var watchdogChan <-chan time.Time
+	if m.cfg.WatchdogInterval > 0 {
+		watchdogTicker := m.cfg.Clock.NewTicker(m.cfg.WatchdogInterval / 2)
+		defer watchdogTicker.Stop()
+		watchdogChan = watchdogTicker.C()
+	}
+
+	ready := false
+	checkReady := func() {
+		if !ready && m.cfg.Registry.ProbeOK(m.cfg.ReadyProbes) {
+			ready = true
+			m.notify("READY=1")
+		}
+	}
+
+	statusChan := m.cfg.StatusChan
+	checkReady()
+	for {
+		select {
+		case <-pollTicker.C():
+			checkReady()
+
+		case <-watchdogChan:
+			if m.cfg.Registry.ProbeOK(m.cfg.WatchdogProbes) {
+				m.notify("WATCHDOG=1")
+			}
+
+		case status, ok := <-statusChan:
+			if !ok {
+				statusChan = nil
+				m.notify("STOPPING=1")
+				continue
+			}
+
+			m.notify("STATUS=" + strings.Replace(status, "\n", " ", -1))
+
+		case <-m.stopChan:
+			return
+		}
+	}
+}
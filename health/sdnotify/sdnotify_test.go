@@ -0,0 +1,69 @@
+package sdnotify
+
+import "github.com/hlandau/degoutils/clock"
+import "github.com/hlandau/degoutils/health"
+import "io/ioutil"
+import "net"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+func TestMonitor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdnotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expect := func(msg string) {
+		buf := make([]byte, 256)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("expected %q: %v", msg, err)
+		}
+		if string(buf[0:n]) != msg {
+			t.Fatalf("expected %q, got %q", msg, buf[0:n])
+		}
+	}
+
+	clk := clock.NewSlowAt(time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := health.NewRegistry()
+	c := r.NewProbeCriterion("db", false, health.Readiness)
+	statusChan := make(chan string)
+
+	m, err := Start(Config{
+		Notifier:         New(path),
+		Registry:         r,
+		WatchdogInterval: 10 * time.Second,
+		StatusChan:       statusChan,
+		Clock:            clk,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	statusChan <- "connecting"
+	expect("STATUS=connecting")
+
+	// Watchdog pings are sent while live even though not ready.
+	clk.BlockUntil(2)
+	clk.Advance(5 * time.Second)
+	expect("WATCHDOG=1")
+
+	c.Inc()
+	clk.Advance(1 * time.Second)
+	expect("READY=1")
+
+	close(statusChan)
+	expect("STOPPING=1")
+}
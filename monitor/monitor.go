@@ -2,6 +2,11 @@
 // informed when they exit.
 package monitor
 
+import "github.com/hlandau/degoutils/clock"
+import "fmt"
+import "runtime/debug"
+import "time"
+
 type EventType int
 
 const (
@@ -10,30 +15,83 @@ const (
 	RuntimeExit                  // The goroutine was terminated via runtime.Goexit().
 )
 
+func (et EventType) String() string {
+	switch et {
+	case NormalExit:
+		return "normal exit"
+	case PanicExit:
+		return "panic"
+	case RuntimeExit:
+		return "runtime exit"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(et))
+	}
+}
+
 // A goroutine monitoring event.
 type Event struct {
 	Type  EventType
 	Panic interface{} // If the goroutine panicked, this is the panic value.
 	Error error       // The value returned by the function.
+
+	// If the goroutine panicked, the stack of the goroutine at the time of the
+	// panic, as formatted by runtime/debug.Stack.
+	Stack []byte
+
+	StartTime time.Time // When the function was called.
+	ExitTime  time.Time // When the function returned or panicked.
+}
+
+// Returns how long the function ran for.
+func (e *Event) Duration() time.Duration {
+	return e.ExitTime.Sub(e.StartTime)
+}
+
+// Returns true if the goroutine panicked, was terminated via
+// runtime.Goexit() or returned a non-nil error.
+func (e *Event) Abnormal() bool {
+	return e.Type != NormalExit || e.Error != nil
+}
+
+func (e *Event) String() string {
+	s := fmt.Sprintf("%v after %v", e.Type, e.Duration())
+	switch {
+	case e.Type == PanicExit:
+		s += fmt.Sprintf(": %v\n%s", e.Panic, e.Stack)
+	case e.Error != nil:
+		s += fmt.Sprintf(": %v", e.Error)
+	}
+	return s
 }
 
 // Runs a function in a goroutine. When the goroutine exits, send a single
 // event on the returned channel.
 func Monitor(f func() error) <-chan Event {
+	return MonitorClock(clock.Real, f)
+}
+
+// Like Monitor, but the start and exit times are taken from the given clock.
+func MonitorClock(clk clock.Clock, f func() error) <-chan Event {
 	ch := make(chan Event, 1)
 
 	go func() {
 		normalExit := false
 		var err error
+		e := Event{StartTime: clk.Now()}
 		defer func() {
 			r := recover()
+			e.ExitTime = clk.Now()
 			if r != nil {
-				ch <- Event{PanicExit, r, nil}
+				e.Type = PanicExit
+				e.Panic = r
+				e.Stack = debug.Stack()
 			} else if normalExit {
-				ch <- Event{NormalExit, nil, err}
+				e.Type = NormalExit
+				e.Error = err
 			} else {
-				ch <- Event{RuntimeExit, nil, nil}
+				e.Type = RuntimeExit
 			}
+			ch <- e
 		}()
 
 		err = f()
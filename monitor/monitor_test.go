@@ -0,0 +1,48 @@
+package monitor
+
+import "github.com/hlandau/degoutils/clock"
+import "fmt"
+import "runtime"
+import "strings"
+import "testing"
+import "time"
+
+func panicker() error {
+	panic("oops")
+}
+
+func TestMonitor(t *testing.T) {
+	e := <-Monitor(func() error {
+		return fmt.Errorf("failed")
+	})
+	if e.Type != NormalExit || e.Error == nil || !e.Abnormal() {
+		t.Fatalf("unexpected event: %v", &e)
+	}
+	if e.StartTime.IsZero() || e.ExitTime.Before(e.StartTime) || e.Duration() < 0 {
+		t.Fatalf("bad timestamps: %v, %v", e.StartTime, e.ExitTime)
+	}
+
+	e = <-Monitor(panicker)
+	if e.Type != PanicExit || e.Panic != "oops" {
+		t.Fatalf("unexpected event: %v", &e)
+	}
+	if !strings.Contains(string(e.Stack), "monitor.panicker") {
+		t.Fatalf("stack does not show panic site:\n%s", e.Stack)
+	}
+
+	e = <-Monitor(func() error {
+		runtime.Goexit()
+		return nil
+	})
+	if e.Type != RuntimeExit || e.Stack != nil {
+		t.Fatalf("unexpected event: %v", &e)
+	}
+}
+
+func TestMonitorClock(t *testing.T) {
+	epoch := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	e := <-MonitorClock(clock.NewSlowAt(epoch), panicker)
+	if e.Type != PanicExit || !e.StartTime.Equal(epoch) || !e.ExitTime.Equal(epoch) {
+		t.Fatalf("unexpected event: %v, %v, %v", &e, e.StartTime, e.ExitTime)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import "github.com/hlandau/degoutils/log"
+import "github.com/hlandau/degoutils/perm"
+import "gopkg.in/alecthomas/kingpin.v2"
+import "fmt"
+import "os"
+import "sort"
+
+var (
+	root = kingpin.New("permtool", "Permission set tool")
+
+	check         = root.Command("check", "Check an implications file for syntax errors and cycles")
+	checkFilename = check.Arg("filename", "Path to the implications file").Required().String()
+
+	closure             = root.Command("closure", "Print the permission set derived from base permissions")
+	closureImplications = closure.Flag("implications", "Path to the implications file").Short('i').Required().String()
+	closurePermissions  = closure.Arg("permission", "Base permissions, such as \"foo(1)\"").Strings()
+
+	can             = root.Command("can", "Test whether base permissions allow a verb under a policy")
+	canPolicy       = can.Flag("policy", "Path to the policy file").Short('p').Required().String()
+	canSection      = can.Flag("section", "Name of the policy in the policy file").Short('s').String()
+	canImplications = can.Flag("implications", "Path to an implications file to apply first").Short('i').String()
+	canOwner        = can.Flag("owner", "Owner ID of the object being accessed").Short('o').String()
+	canVerb         = can.Arg("verb", "The verb to test").Required().String()
+	canPermissions  = can.Arg("permission", "Base permissions, such as \"foo(1)\"").Strings()
+)
+
+func parsePermissions(ss []string) perm.PermissionSet {
+	ps := perm.PermissionSet{}
+	for _, s := range ss {
+		p, err := perm.ParsePermission(s)
+		log.Fatale(err, "invalid permission")
+		ps.Merge(p)
+	}
+	return ps
+}
+
+func loadImplications(filename string) perm.ImplicationSet {
+	is, err := perm.LoadImplicationsFromFile(filename)
+	log.Fatale(err, "cannot load implications")
+	return is
+}
+
+type permissionSorter []perm.Permission
+
+func (ps permissionSorter) Len() int {
+	return len(ps)
+}
+
+func (ps permissionSorter) Less(i, j int) bool {
+	return ps[i].Name < ps[j].Name
+}
+
+func (ps permissionSorter) Swap(i, j int) {
+	ps[i], ps[j] = ps[j], ps[i]
+}
+
+func doCheck() {
+	is, err := perm.LoadImplicationsFromFile(*checkFilename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *checkFilename, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s: %d implications OK\n", *checkFilename, len(is))
+}
+
+func doClosure() {
+	ps := parsePermissions(*closurePermissions)
+	ps.ApplyImplications(loadImplications(*closureImplications))
+
+	var sorted []perm.Permission
+	for _, p := range ps {
+		sorted = append(sorted, p)
+	}
+	sort.Sort(permissionSorter(sorted))
+
+	for i := range sorted {
+		fmt.Println(sorted[i].String())
+	}
+}
+
+type object struct {
+	owner string
+}
+
+func (o *object) PermOwner() (interface{}, bool) {
+	return o.owner, o.owner != ""
+}
+
+func doCan() {
+	vps, err := perm.LoadVerbPoliciesFromFile(*canPolicy)
+	log.Fatale(err, "cannot load policy")
+
+	policy, ok := vps[*canSection]
+	if !ok {
+		log.Fatal(fmt.Sprintf("policy file has no section %#v", *canSection))
+	}
+
+	ps := parsePermissions(*canPermissions)
+	if *canImplications != "" {
+		ps.ApplyImplications(loadImplications(*canImplications))
+	}
+
+	if policy.AllowsVerbObj(*canVerb, ps, &object{owner: *canOwner}) {
+		fmt.Println("allowed")
+	} else {
+		fmt.Println("denied")
+		os.Exit(1)
+	}
+}
+
+func main() {
+	switch kingpin.MustParse(root.Parse(os.Args[1:])) {
+	case check.FullCommand():
+		doCheck()
+	case closure.FullCommand():
+		doClosure()
+	case can.FullCommand():
+		doCan()
+	}
+}
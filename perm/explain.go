@@ -0,0 +1,241 @@
+package perm
+
+import "bytes"
+import "fmt"
+import "sort"
+import "time"
+
+// An Explanation describes why a condition is or is not met by a permission
+// set once a set of implications has been applied to it.
+type Explanation struct {
+	// The condition which was explained.
+	Condition Expr
+
+	// Whether the condition is met.
+	Met bool
+
+	// The permissions from the original permission set on which the
+	// derivation depends, ordered by name.
+	Base []Permission
+
+	// The implications on which the derivation depends, in the order in which
+	// they were applied. Each implication's condition is met by the base
+	// permissions and the permissions implied by the implications before it.
+	//
+	// If the condition is not met, these are the implications which were
+	// applied in deriving the parts of the condition which are met.
+	Steps ImplicationSet
+
+	// If the condition is not met, the parts of it which are not met. For
+	// each unmet condition, either the permission is missing or its level is
+	// not as required. A NOT expression appears here if the expression it
+	// negates is met.
+	Missing []Expr
+}
+
+// Explains why a condition is or is not met by a permission set once the
+// given implications have been applied to it. The permission set is not
+// modified.
+func Explain(ps PermissionSet, is ImplicationSet, cond Expr) *Explanation {
+	return ExplainAt(ps, is, cond, time.Now())
+}
+
+// Like Explain, but evaluates the validity of permissions at the given time.
+func ExplainAt(ps PermissionSet, is ImplicationSet, cond Expr, t time.Time) *Explanation {
+	ex := &explainer{
+		t:       t,
+		is:      is,
+		history: map[string][]derivation{},
+		used:    map[int]bool{},
+		base:    map[string]Permission{},
+	}
+
+	ps = ps.Copy()
+	for name, p := range ps {
+		ex.history[name] = []derivation{{p, -1}}
+	}
+
+	newImplicationIndex(is).apply(ps, t, func(i int) {
+		p := ps[is[i].ImpliedPermission.Name]
+		ex.history[p.Name] = append(ex.history[p.Name], derivation{p, len(ex.steps)})
+		ex.steps = append(ex.steps, i)
+	})
+
+	met, _ := checkedEvalAt(cond, ps, t)
+	e := &Explanation{
+		Condition: cond,
+		Met:       met,
+	}
+
+	ex.support(cond, len(ex.steps), &e.Missing)
+
+	var steps []int
+	for step := range ex.used {
+		steps = append(steps, step)
+	}
+	sort.Ints(steps)
+	for _, step := range steps {
+		e.Steps = append(e.Steps, is[ex.steps[step]])
+	}
+
+	for _, p := range ex.base {
+		e.Base = append(e.Base, p)
+	}
+	sort.Sort(permissionSorter(e.Base))
+
+	return e
+}
+
+// A level a permission had from a given step onwards. The step is -1 for
+// permissions in the original permission set.
+type derivation struct {
+	p    Permission
+	step int
+}
+
+type explainer struct {
+	t       time.Time
+	is      ImplicationSet
+	steps   []int                   // step -> index into is
+	history map[string][]derivation // name -> derivations, in step order
+	used    map[int]bool            // steps on which the explanation depends
+	base    map[string]Permission   // base permissions on which the explanation depends
+}
+
+// Returns the derivation of the named permission in effect before the given
+// step.
+func (ex *explainer) at(name string, step int) (derivation, bool) {
+	h := ex.history[name]
+	for i := len(h) - 1; i >= 0; i-- {
+		if h[i].step < step {
+			return h[i], true
+		}
+	}
+	return derivation{}, false
+}
+
+// Records the steps and base permissions which make the met parts of e true
+// before the given step. If missing is not nil, the unmet parts of e are
+// appended to it.
+func (ex *explainer) support(e Expr, step int, missing *[]Expr) {
+	if CheckExpr(e) != nil {
+		if missing != nil {
+			*missing = append(*missing, e)
+		}
+		return
+	}
+
+	ps := PermissionSet{}
+	for _, name := range triggerNames(e) {
+		if d, ok := ex.at(name, step); ok {
+			ps[name] = d.p
+		}
+	}
+
+	switch x := e.(type) {
+	case Condition:
+		if !EvalAt(x, ps, ex.t) {
+			if missing != nil {
+				*missing = append(*missing, x)
+			}
+			return
+		}
+
+		p, ok := ps.LookupAt(x.Name, ex.t)
+		if !ok {
+			// met by the absence of the permission
+			return
+		}
+
+		d, _ := ex.at(p.Name, step)
+		if d.step < 0 {
+			ex.base[p.Name] = p
+		} else if !ex.used[d.step] {
+			ex.used[d.step] = true
+			ex.support(ex.is[ex.steps[d.step]].Condition, d.step, nil)
+		}
+
+	case And:
+		for _, x2 := range x {
+			ex.support(x2, step, missing)
+		}
+
+	case Or:
+		for _, x2 := range x {
+			if EvalAt(x2, ps, ex.t) {
+				ex.support(x2, step, nil)
+				return
+			}
+		}
+		for _, x2 := range x {
+			ex.support(x2, step, missing)
+		}
+
+	default:
+		// A NOT expression is met by the absence of something, so nothing
+		// supports it.
+		if !EvalAt(x, ps, ex.t) && missing != nil {
+			*missing = append(*missing, x)
+		}
+	}
+}
+
+// Returns the explanation in the textual form of an implication set, with the
+// outcome, the base permissions and any unmet conditions given as comments.
+// For example:
+//
+//	# met: d(1)
+//	# base: a(1), b(2)
+//	a(1) => c(1)
+//	b(2) AND c(1) => d(1)
+func (e *Explanation) String() string {
+	var buf bytes.Buffer
+	if e.Met {
+		fmt.Fprintf(&buf, "# met: %v\n", e.Condition)
+	} else {
+		fmt.Fprintf(&buf, "# not met: %v\n", e.Condition)
+	}
+
+	if len(e.Base) > 0 {
+		buf.WriteString("# base: ")
+		for i := range e.Base {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(e.Base[i].String())
+		}
+		buf.WriteString("\n")
+	}
+
+	if len(e.Missing) > 0 {
+		buf.WriteString("# missing: ")
+		for i, x := range e.Missing {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(exprString(x))
+		}
+		buf.WriteString("\n")
+	}
+
+	for i := range e.Steps {
+		buf.WriteString(e.Steps[i].String())
+		buf.WriteString("\n")
+	}
+
+	return buf.String()
+}
+
+type permissionSorter []Permission
+
+func (ps permissionSorter) Len() int {
+	return len(ps)
+}
+
+func (ps permissionSorter) Less(i, j int) bool {
+	return ps[i].Name < ps[j].Name
+}
+
+func (ps permissionSorter) Swap(i, j int) {
+	ps[i], ps[j] = ps[j], ps[i]
+}
@@ -0,0 +1,320 @@
+package perm
+
+import "fmt"
+import "strings"
+import "time"
+
+// An Expr is a boolean expression over a permission set. It is either a
+// single Condition, or a combination of expressions using And, Or and Not.
+//
+// The textual form uses the keywords AND, OR and NOT and parentheses, for
+// example "admin(1) OR (moderator(1) AND NOT banned(1))". NOT binds most
+// tightly, then AND, then OR.
+type Expr interface {
+	// Returns true iff the permission set satisfies the expression. The
+	// validity of permissions is evaluated at the current time; see EvalAt.
+	Eval(ps PermissionSet) bool
+
+	// Returns the textual form of the expression.
+	String() string
+
+	// Calls f for each condition in the expression.
+	walk(f func(c Condition))
+
+	// Returns true iff the permission set satisfies the expression at time t,
+	// and if so, when the first of the permissions on which that depends
+	// expires. The zero time means no expiry.
+	evalAt(ps PermissionSet, t time.Time) (bool, time.Time)
+}
+
+// An expression which is true iff all of its subexpressions are true. Must
+// have at least one subexpression.
+type And []Expr
+
+// An expression which is true iff any of its subexpressions is true. Must
+// have at least one subexpression.
+type Or []Expr
+
+// An expression which is true iff its subexpression is false.
+type Not struct {
+	X Expr
+}
+
+// Returns an error if the expression is malformed, i.e. if it is nil or
+// contains a nil subexpression, an And or Or with no subexpressions, or a Not
+// of nil. Expressions returned by ParseExpr are never malformed.
+//
+// A malformed expression is never met, even if it is negated, and has no
+// valid textual form.
+func CheckExpr(e Expr) error {
+	switch x := e.(type) {
+	case nil:
+		return fmt.Errorf("nil expression")
+	case And:
+		if len(x) == 0 {
+			return fmt.Errorf("AND expression with no operands")
+		}
+		for _, x2 := range x {
+			if err := CheckExpr(x2); err != nil {
+				return err
+			}
+		}
+	case Or:
+		if len(x) == 0 {
+			return fmt.Errorf("OR expression with no operands")
+		}
+		for _, x2 := range x {
+			if err := CheckExpr(x2); err != nil {
+				return err
+			}
+		}
+	case Not:
+		return CheckExpr(x.X)
+	}
+	return nil
+}
+
+// Like e.evalAt, but a malformed expression is never met.
+func checkedEvalAt(e Expr, ps PermissionSet, t time.Time) (bool, time.Time) {
+	if CheckExpr(e) != nil {
+		return false, time.Time{}
+	}
+	return e.evalAt(ps, t)
+}
+
+// Returns true iff the permission set satisfies the expression, evaluating
+// the validity of permissions at the given time. A malformed expression is
+// never satisfied.
+func EvalAt(e Expr, ps PermissionSet, t time.Time) bool {
+	met, _ := checkedEvalAt(e, ps, t)
+	return met
+}
+
+// Returns the textual form of an expression, which may be nil.
+func exprString(e Expr) string {
+	if e == nil {
+		return "<nil>"
+	}
+	return e.String()
+}
+
+func (c Condition) Eval(ps PermissionSet) bool {
+	return ps.Meets(c)
+}
+
+// The condition remains met at least until the last of the valid grants whose
+// levels match it expires.
+func (c Condition) evalAt(ps PermissionSet, t time.Time) (bool, time.Time) {
+	p, ok := ps.entryAt(c.Name, t)
+	if !ok {
+		return c.Matches(0), time.Time{}
+	}
+
+	g, _ := p.grantAt(t)
+	if !c.Matches(g.Level) {
+		return false, time.Time{}
+	}
+
+	expiry := g.NotAfter
+	for _, g := range p.grants() {
+		if g.ValidAt(t) && c.Matches(g.Level) && expiresBefore(expiry, g.NotAfter) {
+			expiry = g.NotAfter
+		}
+	}
+	return true, expiry
+}
+
+func (c Condition) walk(f func(c Condition)) {
+	f(c)
+}
+
+func (e And) Eval(ps PermissionSet) bool {
+	met, _ := checkedEvalAt(e, ps, time.Now())
+	return met
+}
+
+func (e And) evalAt(ps PermissionSet, t time.Time) (bool, time.Time) {
+	var expiry time.Time
+	for _, x := range e {
+		met, xExpiry := x.evalAt(ps, t)
+		if !met {
+			return false, time.Time{}
+		}
+		expiry = earliestExpiry(expiry, xExpiry)
+	}
+	return true, expiry
+}
+
+func (e And) String() string {
+	if len(e) == 0 {
+		return "<empty AND>"
+	}
+	return joinExprs([]Expr(e), " AND ", func(x Expr) bool {
+		switch x.(type) {
+		case And, Or:
+			return true
+		}
+		return false
+	})
+}
+
+func (e And) walk(f func(c Condition)) {
+	for _, x := range e {
+		if x != nil {
+			x.walk(f)
+		}
+	}
+}
+
+func (e Or) Eval(ps PermissionSet) bool {
+	met, _ := checkedEvalAt(e, ps, time.Now())
+	return met
+}
+
+// If several subexpressions are met, the latest expiry is used.
+func (e Or) evalAt(ps PermissionSet, t time.Time) (bool, time.Time) {
+	anyMet := false
+	var expiry time.Time
+	for _, x := range e {
+		met, xExpiry := x.evalAt(ps, t)
+		if !met {
+			continue
+		}
+		if !anyMet || expiresBefore(expiry, xExpiry) {
+			expiry = xExpiry
+		}
+		anyMet = true
+	}
+	return anyMet, expiry
+}
+
+func (e Or) String() string {
+	if len(e) == 0 {
+		return "<empty OR>"
+	}
+	return joinExprs([]Expr(e), " OR ", func(x Expr) bool {
+		_, ok := x.(Or)
+		return ok
+	})
+}
+
+func (e Or) walk(f func(c Condition)) {
+	for _, x := range e {
+		if x != nil {
+			x.walk(f)
+		}
+	}
+}
+
+func (e Not) Eval(ps PermissionSet) bool {
+	met, _ := checkedEvalAt(e, ps, time.Now())
+	return met
+}
+
+func (e Not) evalAt(ps PermissionSet, t time.Time) (bool, time.Time) {
+	met, _ := e.X.evalAt(ps, t)
+	return !met, time.Time{}
+}
+
+func (e Not) String() string {
+	switch e.X.(type) {
+	case And, Or:
+		return "NOT (" + e.X.String() + ")"
+	}
+	return "NOT " + exprString(e.X)
+}
+
+func (e Not) walk(f func(c Condition)) {
+	if e.X != nil {
+		e.X.walk(f)
+	}
+}
+
+// Joins the textual forms of the expressions with sep, parenthesising those
+// for which paren returns true.
+func joinExprs(xs []Expr, sep string, paren func(x Expr) bool) string {
+	var s []string
+	for _, x := range xs {
+		if paren(x) {
+			s = append(s, "("+x.String()+")")
+		} else {
+			s = append(s, exprString(x))
+		}
+	}
+	return strings.Join(s, sep)
+}
+
+// Returns the names of the permissions referred to by the expression, in
+// order of first appearance.
+func ExprNames(e Expr) []string {
+	if e == nil {
+		return nil
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	e.walk(func(c Condition) {
+		if !seen[c.Name] {
+			seen[c.Name] = true
+			names = append(names, c.Name)
+		}
+	})
+	return names
+}
+
+// Returns the names of the permissions on which the expression depends
+// non-monotonically, that is, those which could make it false if their levels
+// were raised. These are the names in conditions using an operator other than
+// OpGE, and those beneath a Not.
+func nonMonotoneNames(e Expr) []string {
+	var names []string
+	seen := map[string]bool{}
+	var visit func(e Expr, negated bool)
+	visit = func(e Expr, negated bool) {
+		switch x := e.(type) {
+		case Condition:
+			if (negated || x.Op != OpGE) && !seen[x.Name] {
+				seen[x.Name] = true
+				names = append(names, x.Name)
+			}
+		case And:
+			for _, x2 := range x {
+				visit(x2, negated)
+			}
+		case Or:
+			for _, x2 := range x {
+				visit(x2, negated)
+			}
+		case Not:
+			visit(x.X, true)
+		}
+	}
+
+	visit(e, false)
+	return names
+}
+
+// Returns an expression like e, but with each condition replaced by the result
+// of calling f on it.
+func mapExpr(e Expr, f func(c Condition) Expr) Expr {
+	switch x := e.(type) {
+	case Condition:
+		return f(x)
+	case And:
+		e2 := make(And, len(x))
+		for i := range x {
+			e2[i] = mapExpr(x[i], f)
+		}
+		return e2
+	case Or:
+		e2 := make(Or, len(x))
+		for i := range x {
+			e2[i] = mapExpr(x[i], f)
+		}
+		return e2
+	case Not:
+		return Not{mapExpr(x.X, f)}
+	default:
+		return e
+	}
+}
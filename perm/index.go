@@ -0,0 +1,305 @@
+package perm
+
+import "fmt"
+import "sort"
+import "strings"
+import "time"
+
+// An ImplicationIndex is an ImplicationSet compiled for repeated application.
+// Implications are indexed by the names of the permissions in their
+// conditions, and by the wildcard permissions which could apply to those
+// names, so that applying the index only considers implications whose
+// conditions may have been affected by a change to the permission set.
+//
+// Implications are divided into layers, which are applied in order. An
+// implication whose condition could be made false by raising a permission
+// (see nonMonotoneNames) is placed in a later layer than every implication
+// which could raise that permission, so that it is only evaluated once the
+// permission is final.
+type ImplicationIndex struct {
+	is     ImplicationSet
+	layers []indexLayer
+}
+
+type indexLayer struct {
+	byName map[string][]int // permission name -> indices into is
+	zero   []int            // implications whose conditions are met by an empty permission set
+}
+
+// Compiles an implication set into an index. Returns an error if the condition
+// of any implication is malformed (see CheckExpr), or a *CycleError if the set
+// contains a cycle.
+func NewImplicationIndex(is ImplicationSet) (*ImplicationIndex, error) {
+	for i := range is {
+		if err := CheckExpr(is[i].Condition); err != nil {
+			return nil, fmt.Errorf("implication %d: %v", i, err)
+		}
+	}
+
+	if cycle := is.FindCycle(); cycle != nil {
+		return nil, &CycleError{Cycle: cycle}
+	}
+
+	return newImplicationIndex(is), nil
+}
+
+func newImplicationIndex(is ImplicationSet) *ImplicationIndex {
+	idx := &ImplicationIndex{
+		is: is,
+	}
+
+	empty := PermissionSet{}
+	for i, l := range implicationLayers(is) {
+		for len(idx.layers) <= l {
+			idx.layers = append(idx.layers, indexLayer{byName: map[string][]int{}})
+		}
+
+		layer := &idx.layers[l]
+		for _, name := range triggerNames(is[i].Condition) {
+			layer.byName[name] = append(layer.byName[name], i)
+		}
+		if met, _ := checkedEvalAt(is[i].Condition, empty, time.Time{}); met {
+			layer.zero = append(layer.zero, i)
+		}
+	}
+
+	return idx
+}
+
+// Assigns each implication to a layer. An implication is in the same or a
+// later layer than the implications which imply the permissions its condition
+// depends on, and in a strictly later layer if it depends on one of them
+// non-monotonically. If the set contains a cycle, the layers are arbitrary.
+func implicationLayers(is ImplicationSet) []int {
+	implying := map[string][]int{}
+	for i := range is {
+		name := is[i].ImpliedPermission.Name
+		implying[name] = append(implying[name], i)
+	}
+
+	layers := make([]int, len(is))
+	done := make([]bool, len(is))
+	var layerOf func(i int) int
+	layerOf = func(i int) int {
+		if done[i] {
+			return layers[i]
+		}
+		done[i] = true
+
+		names, negative := implicationTriggers(&is[i])
+		for _, name := range names {
+			for _, j := range implying[name] {
+				l := layerOf(j)
+				if negative[name] {
+					l++
+				}
+				if l > layers[i] {
+					layers[i] = l
+				}
+			}
+		}
+		return layers[i]
+	}
+
+	for i := range is {
+		layerOf(i)
+	}
+	return layers
+}
+
+// Returns the implication set from which the index was compiled.
+func (idx *ImplicationIndex) Implications() ImplicationSet {
+	return idx.is
+}
+
+// Applies the implications to the permission set until no more apply. See
+// PermissionSet.ApplyImplications.
+func (idx *ImplicationIndex) Apply(ps PermissionSet) {
+	idx.ApplyAt(ps, time.Now())
+}
+
+// Like Apply, but evaluates validity at the given time.
+func (idx *ImplicationIndex) ApplyAt(ps PermissionSet, t time.Time) {
+	idx.apply(ps, t, nil)
+}
+
+// Like ApplyAt, but calls fired, if it is not nil, with the index of each
+// implication which changes the permission set, in the order they do so.
+func (idx *ImplicationIndex) apply(ps PermissionSet, t time.Time, fired func(i int)) {
+	ps.PruneAt(t)
+
+	// Names of permissions whose implications must be (re)considered.
+	var work []string
+
+	apply := func(i int) {
+		impl := &idx.is[i]
+		if ps.applyImplicationAt(impl, t) {
+			work = append(work, impl.ImpliedPermission.Name)
+			if fired != nil {
+				fired(i)
+			}
+		}
+	}
+
+	for _, layer := range idx.layers {
+		for name := range ps {
+			work = append(work, name)
+		}
+
+		for _, i := range layer.zero {
+			apply(i)
+		}
+
+		for len(work) > 0 {
+			name := work[len(work)-1]
+			work = work[:len(work)-1]
+			for _, i := range layer.byName[name] {
+				apply(i)
+			}
+		}
+	}
+}
+
+// Returns the names of the permissions which, if added to a permission set or
+// raised, could change the value of the expression. This includes wildcard
+// permissions which could apply to the names in the expression.
+func triggerNames(e Expr) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, name := range ExprNames(e) {
+		for _, k := range grantingNames(name) {
+			if !seen[k] {
+				seen[k] = true
+				names = append(names, k)
+			}
+		}
+	}
+	return names
+}
+
+// Returned when an implication set contains a cycle, such as
+// "a(1) => b(1), b(1) => a(1)".
+type CycleError struct {
+	// The names of the permissions forming the cycle. The first name is
+	// repeated at the end.
+	Cycle []string
+}
+
+func (e *CycleError) Error() string {
+	return "implication cycle: " + strings.Join(e.Cycle, " => ")
+}
+
+// Returns the trigger names of the implication's condition (see
+// triggerNames), and those on which it depends non-monotonically. A wildcard
+// which the implication implies and which grants a name in its condition is
+// omitted if the condition neither names it nor depends on it
+// non-monotonically: an implication such as "root(1) => *(1)" can only raise
+// that permission further, so it does not depend on itself.
+func implicationTriggers(impl *Implication) (names []string, negative map[string]bool) {
+	named := map[string]bool{}
+	for _, name := range ExprNames(impl.Condition) {
+		named[name] = true
+	}
+
+	negative = map[string]bool{}
+	for _, name := range nonMonotoneNames(impl.Condition) {
+		for _, k := range grantingNames(name) {
+			negative[k] = true
+		}
+	}
+
+	implied := impl.ImpliedPermission.Name
+	for _, name := range triggerNames(impl.Condition) {
+		if name == implied && !named[name] && !negative[name] {
+			continue
+		}
+		names = append(names, name)
+	}
+	return
+}
+
+// Looks for a cycle in the implication set, considering only permission
+// names. An implied wildcard permission is taken to imply every permission
+// beneath it, but an implication such as "root(1) => *(1)", which implies a
+// wildcard granting a name in its own condition, is not a cycle by itself
+// unless the condition depends on that name non-monotonically, as in
+// "NOT root(1) => *(1)". If one is found, returns the names of the permissions
+// forming it, with the first name repeated at the end; otherwise returns nil.
+func (is ImplicationSet) FindCycle() []string {
+	edges := map[string][]string{}
+	for i := range is {
+		implied := is[i].ImpliedPermission.Name
+		names, _ := implicationTriggers(&is[i])
+		for _, name := range names {
+			edges[name] = append(edges[name], implied)
+		}
+	}
+
+	var names []string
+	for name := range edges {
+		names = append(names, name)
+	}
+	// Wildcards are visited last so that cycles are reported in terms of
+	// the permissions named in the implications where possible.
+	sort.Sort(cycleNameSorter(names))
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	var path []string
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			for i, n := range path {
+				if n == name {
+					cycle := append([]string(nil), path[i:]...)
+					return append(cycle, name)
+				}
+			}
+		}
+
+		state[name] = visiting
+		path = append(path, name)
+		for _, next := range edges[name] {
+			if cycle := visit(next); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		return nil
+	}
+
+	for _, name := range names {
+		if cycle := visit(name); cycle != nil {
+			return cycle
+		}
+	}
+
+	return nil
+}
+
+type cycleNameSorter []string
+
+func (s cycleNameSorter) Len() int {
+	return len(s)
+}
+
+func (s cycleNameSorter) Less(i, j int) bool {
+	wi, wj := strings.HasSuffix(s[i], "*"), strings.HasSuffix(s[j], "*")
+	if wi != wj {
+		return wj
+	}
+	return s[i] < s[j]
+}
+
+func (s cycleNameSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
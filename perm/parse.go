@@ -7,9 +7,12 @@ import "strconv"
 import "os"
 import "io/ioutil"
 
-var re_tuple = regexp.MustCompilePOSIX(`^([a-z0-9._:-]+)\(([0-9]+)\)`)
+var re_tuple = regexp.MustCompilePOSIX(`^([a-z0-9._:*-]+)\(([^()]*)\)`)
+var re_level = regexp.MustCompilePOSIX(`^-?[0-9]+$`)
+var re_section = regexp.MustCompilePOSIX(`^\[([a-z0-9._:-]*)\]$`)
+var re_verb = regexp.MustCompilePOSIX(`^[a-z0-9._:*-]+`)
 
-// Parse a permission string such as "some-permission(5)".
+// Parse a permission string such as "some-permission(5)" or "can-access(-1)".
 func ParsePermission(permission string) (Permission, error) {
 	p, rest, err := parsePermission(permission)
 	if err != nil {
@@ -23,7 +26,10 @@ func ParsePermission(permission string) (Permission, error) {
 	return p, nil
 }
 
-// Parse a condition string such as "some-permission(5)".
+// Parse a condition string such as "some-permission(5)". Levels may be
+// negative. Besides the default "greater than or equal to" comparison, the
+// forms "name(<=n)", "name(==n)", "name(!=n)" and the inclusive range
+// "name(m..n)" are accepted; "name(>=n)" is the same as "name(n)".
 func ParseCondition(condition string) (Condition, error) {
 	p, rest, err := parseCondition(condition)
 	if err != nil {
@@ -37,9 +43,30 @@ func ParseCondition(condition string) (Condition, error) {
 	return p, nil
 }
 
+// Parse a condition expression string such as
+// "admin(1) OR (moderator(1) AND verified(1))". See Expr.
+func ParseExpr(expr string) (Expr, error) {
+	e, rest, err := parseExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	rest = skiphws(rest)
+	if rest != "" {
+		return nil, fmt.Errorf("trailing data in expression string: %#v", rest)
+	}
+
+	return e, nil
+}
+
 // Parses an implications string such as "a(1) => b(2), c(3) => d(4)".
+// The left side of each implication may be any expression, as accepted by
+// ParseExpr.
 //
-// Implications may be separated by commas or newlines.
+// Implications may be separated by commas or newlines. Comments begin with
+// "#" and blank lines are ignored.
+//
+// Errors are reported with the line number at which they occur.
 func ParseImplications(implications string) (ImplicationSet, error) {
 	return parseImplications(implications)
 }
@@ -52,9 +79,14 @@ func parseImplications(implications string) (is ImplicationSet, err error) {
 			break
 		}
 
+		// An implication cannot span lines, so errors are reported at the line on
+		// which it begins.
+		line := 1 + strings.Count(implications[:len(implications)-len(rest)], "\n")
+
 		var impl Implication
 		impl, rest, err = parseImplication(rest)
 		if err != nil {
+			err = fmt.Errorf("line %d: %v", line, err)
 			return
 		}
 
@@ -64,7 +96,7 @@ func parseImplications(implications string) (is ImplicationSet, err error) {
 			break
 		}
 		if rest[0] != ',' && rest[0] != '\n' {
-			err = fmt.Errorf("expected comma or newline after implication, got %#v", rest)
+			err = fmt.Errorf("line %d: expected comma or newline after implication, got %#v", line, rest)
 			return
 		}
 		rest = rest[1:]
@@ -77,7 +109,7 @@ func parseImplication(implication string) (impl Implication, rest string, err er
 	rest = implication
 	rest = skiphws(rest)
 
-	cond, rest, err := parseCondition(rest)
+	cond, rest, err := parseExpr(rest)
 	if err != nil {
 		return
 	}
@@ -104,6 +136,95 @@ func parseImplication(implication string) (impl Implication, rest string, err er
 	return
 }
 
+// expr := and-expr { "OR" and-expr }
+func parseExpr(expr string) (e Expr, rest string, err error) {
+	var or Or
+	rest = expr
+	for {
+		e, rest, err = parseAndExpr(rest)
+		if err != nil {
+			return
+		}
+
+		or = append(or, e)
+		rest = skiphws(rest)
+		if !hasKeyword(rest, "OR") {
+			break
+		}
+		rest = rest[2:]
+	}
+
+	if len(or) > 1 {
+		e = or
+	}
+	return
+}
+
+// and-expr := unary-expr { "AND" unary-expr }
+func parseAndExpr(expr string) (e Expr, rest string, err error) {
+	var and And
+	rest = expr
+	for {
+		e, rest, err = parseUnaryExpr(rest)
+		if err != nil {
+			return
+		}
+
+		and = append(and, e)
+		rest = skiphws(rest)
+		if !hasKeyword(rest, "AND") {
+			break
+		}
+		rest = rest[3:]
+	}
+
+	if len(and) > 1 {
+		e = and
+	}
+	return
+}
+
+// unary-expr := "NOT" unary-expr | "(" expr ")" | condition
+func parseUnaryExpr(expr string) (e Expr, rest string, err error) {
+	rest = skiphws(expr)
+	switch {
+	case hasKeyword(rest, "NOT"):
+		e, rest, err = parseUnaryExpr(rest[3:])
+		if err != nil {
+			return
+		}
+		e = Not{e}
+
+	case rest != "" && rest[0] == '(':
+		e, rest, err = parseExpr(rest[1:])
+		if err != nil {
+			return
+		}
+		rest = skiphws(rest)
+		if rest == "" || rest[0] != ')' {
+			err = fmt.Errorf("expected ')' in expression string, got %#v", rest)
+			return
+		}
+		rest = rest[1:]
+
+	default:
+		e, rest, err = parseCondition(rest)
+	}
+
+	return
+}
+
+// Returns true if s begins with the given keyword, followed by whitespace or
+// an opening parenthesis.
+func hasKeyword(s, kw string) bool {
+	if !strings.HasPrefix(s, kw) {
+		return false
+	}
+
+	s = s[len(kw):]
+	return s != "" && (s[0] == ' ' || s[0] == '\t' || s[0] == '(')
+}
+
 func skiphws(s string) string {
 	return strings.TrimLeft(s, " \t\r")
 }
@@ -127,7 +248,12 @@ func skipws(s string) string {
 }
 
 func parsePermission(permission string) (p Permission, rest string, err error) {
-	name, level, rest, err := parseTuple(permission)
+	name, arg, rest, err := parseTuple(permission)
+	if err != nil {
+		return Permission{}, "", err
+	}
+
+	level, err := parseLevel(arg)
 	if err != nil {
 		return Permission{}, "", err
 	}
@@ -138,20 +264,57 @@ func parsePermission(permission string) (p Permission, rest string, err error) {
 	}, rest, nil
 }
 
-func parseCondition(condition string) (p Condition, rest string, err error) {
-	name, level, rest, err := parseTuple(condition)
+var conditionOperators = []struct {
+	s  string
+	op Operator
+}{
+	{">=", OpGE},
+	{"<=", OpLE},
+	{"==", OpEQ},
+	{"!=", OpNE},
+}
+
+func parseCondition(condition string) (c Condition, rest string, err error) {
+	name, arg, rest, err := parseTuple(condition)
 	if err != nil {
 		return Condition{}, "", err
 	}
 
-	return Condition{
-		Name:     name,
-		MinLevel: level,
-	}, rest, nil
+	c.Name = name
+	hasOp := false
+	for _, o := range conditionOperators {
+		if strings.HasPrefix(arg, o.s) {
+			c.Op = o.op
+			arg = arg[len(o.s):]
+			hasOp = true
+			break
+		}
+	}
+
+	if idx := strings.Index(arg, ".."); idx >= 0 && !hasOp {
+		c.Op = OpRange
+		c.MaxLevel, err = parseLevel(arg[idx+2:])
+		if err != nil {
+			return Condition{}, "", err
+		}
+		arg = arg[:idx]
+	}
+
+	c.MinLevel, err = parseLevel(arg)
+	if err != nil {
+		return Condition{}, "", err
+	}
+
+	if c.Op == OpRange && c.MaxLevel < c.MinLevel {
+		return Condition{}, "", fmt.Errorf("empty range in condition string: %#v", condition)
+	}
+
+	return c, rest, nil
 }
 
-// Parse a (string, int)-tuple string such as "some-permission(5)".
-func parseTuple(tuple string) (name string, level int, rest string, err error) {
+// Parse a (string, string)-tuple string such as "some-permission(5)",
+// returning the name and the parenthesised argument.
+func parseTuple(tuple string) (name, arg, rest string, err error) {
 	m := re_tuple.FindStringSubmatch(tuple)
 	if m == nil {
 		err = fmt.Errorf("invalid permission/condition string: %#v", tuple)
@@ -159,18 +322,144 @@ func parseTuple(tuple string) (name string, level int, rest string, err error) {
 	}
 
 	name = m[1]
-	levels := m[2]
-	leveln, err := strconv.ParseInt(levels, 10, 32)
-	if err != nil {
+	if !validName(name) {
+		err = fmt.Errorf("invalid wildcard in permission/condition string: %#v", tuple)
 		return
 	}
 
-	level = int(leveln)
+	arg = m[2]
 	rest = tuple[len(m[0]):]
 	return
 }
 
-// Load implications in the textual form from a file.
+// A wildcard may only appear as the whole of the last segment of a name, as
+// in "*", "admin.*" or "project:7:*".
+func validName(name string) bool {
+	idx := strings.IndexByte(name, '*')
+	if idx < 0 {
+		return true
+	}
+
+	if idx != len(name)-1 {
+		return false
+	}
+
+	return idx == 0 || name[idx-1] == '.' || name[idx-1] == ':'
+}
+
+// Parse a signed decimal level such as "-1".
+func parseLevel(s string) (int, error) {
+	if !re_level.MatchString(s) {
+		return 0, fmt.Errorf("invalid level: %#v", s)
+	}
+
+	leveln, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(leveln), nil
+}
+
+// Parses a policy file mapping verbs to conditions, such as:
+//
+//	# Verbs before any section header belong to the policy named "".
+//	view = view(1)
+//
+//	[document]
+//	view = owner(1) OR viewer(1)
+//	edit = owner(1) OR (editor(1) AND NOT suspended(1))
+//	admin.* = admin(1)
+//
+// Each line other than a section header is of the form "verb = condition",
+// where the condition is any expression accepted by ParseExpr, and may use
+// the "owner" pseudo-condition described for VerbPolicy. Verbs may be
+// wildcards. Comments begin with "#" and blank lines are ignored.
+//
+// Errors are reported with the line number at which they occur.
+func ParseVerbPolicies(policies string) (VerbPolicySet, error) {
+	vps := VerbPolicySet{}
+	name := ""
+	for i, line := range strings.Split(policies, "\n") {
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if line[0] == '[' {
+			m := re_section.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("line %d: invalid section header: %#v", i+1, line)
+			}
+
+			name = m[1]
+			if _, ok := vps[name]; ok {
+				return nil, fmt.Errorf("line %d: duplicate section: %#v", i+1, name)
+			}
+
+			vps[name] = &VerbPolicy{Verbs: map[string]Expr{}}
+			continue
+		}
+
+		verb, e, err := parseVerbLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+
+		p, ok := vps[name]
+		if !ok {
+			p = &VerbPolicy{Verbs: map[string]Expr{}}
+			vps[name] = p
+		}
+
+		if _, ok := p.Verbs[verb]; ok {
+			return nil, fmt.Errorf("line %d: duplicate verb: %#v", i+1, verb)
+		}
+
+		p.Verbs[verb] = e
+	}
+
+	return vps, nil
+}
+
+func parseVerbLine(line string) (verb string, e Expr, err error) {
+	verb = re_verb.FindString(line)
+	if verb == "" || !validName(verb) {
+		err = fmt.Errorf("invalid verb: %#v", line)
+		return
+	}
+
+	rest := skiphws(line[len(verb):])
+	if rest == "" || rest[0] != '=' {
+		err = fmt.Errorf("expected '=' after verb %#v", verb)
+		return
+	}
+
+	e, err = ParseExpr(skiphws(rest[1:]))
+	return
+}
+
+// Load verb policies in the textual form from a file. See ParseVerbPolicies.
+func LoadVerbPoliciesFromFile(filename string) (VerbPolicySet, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	vps, err := ParseVerbPolicies(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	return vps, nil
+}
+
+// Load implications in the textual form from a file. Returns a *CycleError
+// if the implications contain a cycle.
 func LoadImplicationsFromFile(filename string) (ImplicationSet, error) {
 	f, err := os.Open(filename)
 	if err != nil {
@@ -183,5 +472,14 @@ func LoadImplicationsFromFile(filename string) (ImplicationSet, error) {
 		return nil, err
 	}
 
-	return ParseImplications(string(data))
+	is, err := ParseImplications(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if cycle := is.FindCycle(); cycle != nil {
+		return nil, &CycleError{Cycle: cycle}
+	}
+
+	return is, nil
 }
@@ -1,8 +1,16 @@
 // Package perm provides authorization testing functions based on permission sets.
+//
+// Implication.Condition was formerly a Condition, and is now an Expr. The gob
+// encoding of an Implication has changed accordingly, so implications stored
+// in the old gob encoding cannot be decoded into an Implication. To migrate
+// them, decode them into a struct with the same fields, but with Condition of
+// type Condition, and convert each to an Implication. Implications stored in
+// the textual form (see ParseImplications) are unaffected.
 package perm
 
 import "fmt"
 import "strings"
+import "time"
 import "encoding/gob"
 
 func init() {
@@ -11,6 +19,9 @@ func init() {
 	gob.RegisterName("perm.Implication", Implication{})
 	gob.RegisterName("perm.ImplicationSet", ImplicationSet{})
 	gob.RegisterName("perm.Condition", Condition{})
+	gob.RegisterName("perm.And", And{})
+	gob.RegisterName("perm.Or", Or{})
+	gob.RegisterName("perm.Not", Not{})
 }
 
 // A Permission is a label which may be possessed by some manner of actor.
@@ -35,6 +46,18 @@ func init() {
 // Permission names should conventionally be formed using lowercase letters, numbers
 // and hyphens, not underscores. The actually permitted set of characters is larger than this;
 // underscores, dots and colons characters are allowed.
+//
+// Names are hierarchical, with dots and colons separating the levels, as in
+// "user-id:42" or "admin.users". A permission whose name ends in a wildcard
+// segment, such as "project:7:*" or "admin.*", applies to every permission
+// beneath it, such as "project:7:edit" or "admin.users.delete". The
+// permission "*" applies to all permissions. See PermissionSet.Lookup for
+// how the applicable permission is chosen.
+//
+// A permission may be granted temporarily by giving it a validity window.
+// Outside its window, a permission in a permission set is treated as though it
+// were absent. Validity is evaluated at the current time, or at a given time
+// by the methods and functions whose names end in At.
 type Permission struct {
 	// The permission name.
 	Name string
@@ -42,6 +65,104 @@ type Permission struct {
 	// The permission level. Aabsent permissions default to level 0, present
 	// permissions default to level 1.
 	Level int
+
+	// If not zero, the permission is not valid before this time.
+	NotBefore time.Time
+
+	// If not zero, the permission expires at this time.
+	NotAfter time.Time
+
+	// Further grants of the same permission with other levels or validity
+	// windows, as kept by PermissionSet.Merge, or nil if there are none. The
+	// grants here have no Grants of their own. Where several grants are valid,
+	// the one with the highest level applies.
+	//
+	// This is a pointer so that Permission remains comparable. The slice may be
+	// shared between copies of a Permission, and must not be modified. Two
+	// permissions with further grants are equal only if they share them.
+	Grants *[]Permission
+}
+
+// Returns true iff the permission is valid at the given time.
+func (p *Permission) ValidAt(t time.Time) bool {
+	return (p.NotBefore.IsZero() || !t.Before(p.NotBefore)) &&
+		(p.NotAfter.IsZero() || t.Before(p.NotAfter))
+}
+
+// Returns true iff the permission has expired at the given time.
+func (p *Permission) ExpiredAt(t time.Time) bool {
+	return !p.NotAfter.IsZero() && !t.Before(p.NotAfter)
+}
+
+// Returns the grants making up the permission: the permission itself, without
+// its Grants, followed by its Grants.
+func (p *Permission) grants() []Permission {
+	p2 := *p
+	p2.Grants = nil
+	gs := []Permission{p2}
+	if p.Grants != nil {
+		gs = append(gs, *p.Grants...)
+	}
+	return gs
+}
+
+// Returns the grant which applies at the given time. Returns false if no grant
+// is valid.
+func (p *Permission) grantAt(t time.Time) (Permission, bool) {
+	gs := p.grants()
+	i := bestGrant(gs, t)
+	if i < 0 {
+		return Permission{}, false
+	}
+	return gs[i], true
+}
+
+// Returns the index of the grant which applies at the given time: the valid
+// grant with the highest level, or of those, the one which expires last.
+// Returns -1 if no grant is valid.
+func bestGrant(gs []Permission, t time.Time) int {
+	best := -1
+	for i := range gs {
+		if !gs[i].ValidAt(t) {
+			continue
+		}
+		if best < 0 || gs[i].Level > gs[best].Level ||
+			(gs[i].Level == gs[best].Level && expiresBefore(gs[best].NotAfter, gs[i].NotAfter)) {
+			best = i
+		}
+	}
+	return best
+}
+
+// Returns true iff grant p makes grant q redundant, because p has at least the
+// level of q for at least the whole of q's validity window.
+func (p *Permission) covers(q *Permission) bool {
+	return p.Level >= q.Level &&
+		(p.NotBefore.IsZero() || (!q.NotBefore.IsZero() && !q.NotBefore.Before(p.NotBefore))) &&
+		!expiresBefore(p.NotAfter, q.NotAfter)
+}
+
+// Combines grants of the same permission into a single Permission, with the
+// grant which applies at the given time (or if none does, the first) at its
+// head. gs must not be empty.
+func combineGrants(gs []Permission, t time.Time) Permission {
+	head := bestGrant(gs, t)
+	if head < 0 {
+		head = 0
+	}
+
+	p := gs[head]
+	p.Grants = nil
+	var more []Permission
+	for i := range gs {
+		if i != head {
+			more = append(more, gs[i])
+		}
+	}
+	if len(more) > 0 {
+		p.Grants = &more
+	}
+	return p
 }
 
 // Returns a string in the form "name(level)".
@@ -52,20 +173,71 @@ func (p *Permission) String() string {
 // A Condition represents some sort of predicate applied to an actor's
 // permission set.
 //
-// While it currently has the same fields as Permission, it is a different
-// structure because the semantics of the fields are different; MinLevel is
-// greater-than-or-equal-to matched to the Level of a Permission.
+// While it has similar fields to Permission, it is a different structure
+// because the semantics of the fields are different; by default, MinLevel is
+// greater-than-or-equal-to matched to the Level of a Permission. Other
+// comparisons can be selected using Op.
 type Condition struct {
 	// The permission which the condition requires.
 	Name string
 
-	// The minimum level of the permission (greater than or equal to).
+	// The minimum level of the permission (greater than or equal to). For
+	// operators other than OpGE and OpRange, the level compared against.
 	MinLevel int
+
+	// The comparison to perform. The zero value is OpGE.
+	Op Operator
+
+	// For OpRange, the maximum level of the permission (less than or equal
+	// to).
+	MaxLevel int
 }
 
-// Returns a string in the form "name(min-level)".
-func (c *Condition) String() string {
-	return fmt.Sprintf("%s(%d)", c.Name, c.MinLevel)
+// A comparison operator used by a Condition.
+type Operator int
+
+const (
+	OpGE    Operator = iota // level >= MinLevel, written "name(n)" or "name(>=n)"
+	OpLE                    // level <= MinLevel, written "name(<=n)"
+	OpEQ                    // level == MinLevel, written "name(==n)"
+	OpNE                    // level != MinLevel, written "name(!=n)"
+	OpRange                 // MinLevel <= level <= MaxLevel, written "name(m..n)"
+)
+
+// Returns true iff a permission with the given level meets the condition.
+// Absent permissions have level 0.
+func (c Condition) Matches(level int) bool {
+	switch c.Op {
+	case OpGE:
+		return level >= c.MinLevel
+	case OpLE:
+		return level <= c.MinLevel
+	case OpEQ:
+		return level == c.MinLevel
+	case OpNE:
+		return level != c.MinLevel
+	case OpRange:
+		return level >= c.MinLevel && level <= c.MaxLevel
+	default:
+		return false
+	}
+}
+
+// Returns a string in the form "name(min-level)", or one of the other forms
+// listed for the Operator constants.
+func (c Condition) String() string {
+	switch c.Op {
+	case OpLE:
+		return fmt.Sprintf("%s(<=%d)", c.Name, c.MinLevel)
+	case OpEQ:
+		return fmt.Sprintf("%s(==%d)", c.Name, c.MinLevel)
+	case OpNE:
+		return fmt.Sprintf("%s(!=%d)", c.Name, c.MinLevel)
+	case OpRange:
+		return fmt.Sprintf("%s(%d..%d)", c.Name, c.MinLevel, c.MaxLevel)
+	default:
+		return fmt.Sprintf("%s(%d)", c.Name, c.MinLevel)
+	}
 }
 
 // A permission set is a set of permissions held by an actor.
@@ -74,14 +246,86 @@ func (c *Condition) String() string {
 // maintained at all times.)
 type PermissionSet map[string]Permission
 
-// Returns true iff the condition is met.
-func (ps PermissionSet) Meets(c Condition) bool {
-	p, ok := ps[c.Name]
+// Returns the permission in the set which applies to the given name, which is
+// the most specific of:
+//
+//   - the permission with exactly that name, then
+//   - the wildcard permissions above it, longest first, ending with "*".
+//
+// For example, the level of "admin.users.delete" is determined by
+// "admin.users.delete" if it is in the set, otherwise "admin.users.*",
+// otherwise "admin.*", otherwise "*". A more specific permission applies even
+// if its level is lower, so an actor granted "project:*(2)" and
+// "project:7:*(0)" has level 0 for "project:7:edit".
+//
+// Permissions which are not currently valid are ignored. Returns false if no
+// permission applies, in which case the level is 0.
+func (ps PermissionSet) Lookup(name string) (Permission, bool) {
+	return ps.LookupAt(name, time.Now())
+}
+
+// Like Lookup, but evaluates the validity of permissions at the given time.
+func (ps PermissionSet) LookupAt(name string, t time.Time) (Permission, bool) {
+	if len(ps) == 0 {
+		return Permission{}, false
+	}
+
+	p, ok := ps.entryAt(name, t)
 	if !ok {
-		return c.MinLevel <= 0
+		return Permission{}, false
+	}
+	return p.grantAt(t)
+}
+
+// Returns the entry in the set which applies to the given name, including all
+// of its grants. An entry applies if any of its grants is valid.
+func (ps PermissionSet) entryAt(name string, t time.Time) (Permission, bool) {
+	for _, k := range grantingNames(name) {
+		if p, ok := ps[k]; ok {
+			if _, ok := p.grantAt(t); ok {
+				return p, true
+			}
+		}
+	}
+
+	return Permission{}, false
+}
+
+// Returns the names of the permissions which may determine the level of the
+// named permission, most specific first.
+func grantingNames(name string) []string {
+	names := []string{name}
+
+	// A wildcard is not beneath itself.
+	end := len(name)
+	if strings.HasSuffix(name, "*") {
+		end = len(name) - 2
 	}
 
-	return p.Level >= c.MinLevel
+	for i := end - 1; i >= 0; i-- {
+		if name[i] == ':' || name[i] == '.' {
+			names = append(names, name[:i+1]+"*")
+		}
+	}
+
+	if name != "*" {
+		names = append(names, "*")
+	}
+
+	return names
+}
+
+// Returns true iff the condition is met. Wildcard permissions are taken into
+// account as described for Lookup, and permissions which are not currently
+// valid are ignored.
+func (ps PermissionSet) Meets(c Condition) bool {
+	return ps.MeetsAt(c, time.Now())
+}
+
+// Like Meets, but evaluates the validity of permissions at the given time.
+func (ps PermissionSet) MeetsAt(c Condition, t time.Time) bool {
+	p, _ := ps.LookupAt(c.Name, t)
+	return c.Matches(p.Level)
 }
 
 // Returns true if the permission set contains a permission with the given
@@ -90,13 +334,36 @@ func (ps PermissionSet) Meets(c Condition) bool {
 // Note: If level less than or equal to 0, returns true if the user does not
 // have the permission set.
 func (ps PermissionSet) Has(name string, minLevel int) bool {
-	return ps.Meets(Condition{Name: name, MinLevel: minLevel})
+	return ps.HasAt(name, minLevel, time.Now())
+}
+
+// Like Has, but evaluates the validity of permissions at the given time.
+func (ps PermissionSet) HasAt(name string, minLevel int, t time.Time) bool {
+	return ps.MeetsAt(Condition{Name: name, MinLevel: minLevel}, t)
 }
 
 // Returns true iff the permission set contains the permission with the given
 // name with a positive level.
 func (ps PermissionSet) Positive(name string) bool {
-	return ps.Has(name, 1)
+	return ps.PositiveAt(name, time.Now())
+}
+
+// Like Positive, but evaluates the validity of permissions at the given time.
+func (ps PermissionSet) PositiveAt(name string, t time.Time) bool {
+	return ps.HasAt(name, 1, t)
+}
+
+// Returns the permissions which apply at the given time, each with the level
+// of its applicable grant and no validity window, so that evaluating the
+// result at any time gives the same result as evaluating ps at t.
+func (ps PermissionSet) snapshotAt(t time.Time) PermissionSet {
+	ps2 := PermissionSet{}
+	for k, p := range ps {
+		if g, ok := p.grantAt(t); ok {
+			ps2[k] = Permission{Name: g.Name, Level: g.Level}
+		}
+	}
+	return ps2
 }
 
 func (ps PermissionSet) String() string {
@@ -111,32 +378,166 @@ func (ps PermissionSet) String() string {
 // in the set, it is added. If the permission already exists, its level will
 // be raised if the new permission has a higher level; otherwise, nothing is
 // changed.
+//
+// Grants with different validity windows are kept separately (see
+// Permission.Grants), so a temporary elevation does not replace a permanent
+// grant of the same name: once the elevation expires, the permanent grant
+// applies again. A grant is not added if an existing grant has at least its
+// level for at least its validity window, and existing grants which the new
+// grant makes redundant in the same way are dropped. Grants which have expired
+// are not added.
 func (ps PermissionSet) Merge(permission Permission) {
+	ps.MergeAt(permission, time.Now())
+}
+
+// Like Merge, but evaluates validity at the given time.
+func (ps PermissionSet) MergeAt(permission Permission, t time.Time) {
+	ps.mergeAt(permission, t)
+}
+
+// Like MergeAt, but returns true iff the permission set was changed.
+func (ps PermissionSet) mergeAt(permission Permission, t time.Time) bool {
 	p, ok := ps[permission.Name]
 	if !ok {
 		ps[permission.Name] = permission
-		return
+		return true
 	}
 
-	if permission.Level > p.Level {
-		p.Level = permission.Level
+	changed := false
+	var gs []Permission
+	for _, g := range p.grants() {
+		if g.ExpiredAt(t) {
+			changed = true
+			continue
+		}
+		gs = append(gs, g)
 	}
+
+	for _, n := range permission.grants() {
+		if n.ExpiredAt(t) {
+			continue
+		}
+
+		covered := false
+		for i := range gs {
+			if gs[i].covers(&n) {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+
+		gs2 := []Permission{n}
+		for _, g := range gs {
+			if !n.covers(&g) {
+				gs2 = append(gs2, g)
+			}
+		}
+		gs = gs2
+		changed = true
+	}
+
+	if !changed {
+		return false
+	}
+	if len(gs) == 0 {
+		delete(ps, permission.Name)
+	} else {
+		ps[permission.Name] = combineGrants(gs, t)
+	}
+	return true
+}
+
+// Returns true if expiry time a is before expiry time b. The zero time means
+// no expiry.
+func expiresBefore(a, b time.Time) bool {
+	if a.IsZero() {
+		return false
+	}
+	return b.IsZero() || a.Before(b)
 }
 
-// Conditionally apply a given implication.
+// Returns the earlier of two expiry times. The zero time means no expiry.
+func earliestExpiry(a, b time.Time) time.Time {
+	if expiresBefore(b, a) {
+		return b
+	}
+	return a
+}
+
+// Removes permissions, and grants of permissions, which have expired.
+func (ps PermissionSet) Prune() {
+	ps.PruneAt(time.Now())
+}
+
+// Removes permissions, and grants of permissions, which have expired at the
+// given time.
+func (ps PermissionSet) PruneAt(t time.Time) {
+	for k, p := range ps {
+		var gs []Permission
+		for _, g := range p.grants() {
+			if !g.ExpiredAt(t) {
+				gs = append(gs, g)
+			}
+		}
+
+		switch {
+		case len(gs) == 0:
+			delete(ps, k)
+		case len(gs) != len(p.grants()):
+			ps[k] = combineGrants(gs, t)
+		}
+	}
+}
+
+// Conditionally apply a given implication. If the condition is met only
+// because of permissions which expire, the implied permission expires when
+// the first of them does.
 func (ps PermissionSet) ApplyImplication(impl Implication) {
-	if !ps.Meets(impl.Condition) {
-		return
+	ps.ApplyImplicationAt(impl, time.Now())
+}
+
+// Like ApplyImplication, but evaluates validity at the given time.
+func (ps PermissionSet) ApplyImplicationAt(impl Implication, t time.Time) {
+	ps.applyImplicationAt(&impl, t)
+}
+
+// Returns true iff the permission set was changed.
+func (ps PermissionSet) applyImplicationAt(impl *Implication, t time.Time) bool {
+	met, expiry := checkedEvalAt(impl.Condition, ps, t)
+	if !met {
+		return false
 	}
 
-	ps.Merge(impl.ImpliedPermission)
+	p := impl.ImpliedPermission
+	p.NotAfter = earliestExpiry(p.NotAfter, expiry)
+	return ps.mergeAt(p, t)
 }
 
-// Apply a set of implications.
+// Apply a set of implications repeatedly until no more apply, so that
+// permissions implied by implied permissions are also merged, regardless of
+// the order of the implications in the set. Expired permissions are pruned
+// first, and implied permissions expire as described for ApplyImplication.
+//
+// A condition which could become false as levels are raised, such as one
+// using NOT, OpLE, OpEQ, OpNE or OpRange, is only evaluated once every
+// implication which could raise the permissions it depends on has been
+// applied. For example, given "NOT banned(1) => can-access(1)" and
+// "spammer(1) => banned(1)", a spammer does not gain can-access. This relies
+// on the set having no cycles (see FindCycle); an implication whose condition
+// depends non-monotonically on its own implied permission, such as
+// "NOT root(1) => *(1)", is a cycle.
+//
+// If the same set is applied often, use an ImplicationIndex instead.
 func (ps PermissionSet) ApplyImplications(is ImplicationSet) {
-	for i := range is {
-		ps.ApplyImplication(is[i])
-	}
+	ps.ApplyImplicationsAt(is, time.Now())
+}
+
+// Like ApplyImplications, but evaluates validity at the given time.
+func (ps PermissionSet) ApplyImplicationsAt(is ImplicationSet, t time.Time) {
+	newImplicationIndex(is).ApplyAt(ps, t)
 }
 
 // Makes a copy of the permission set.
@@ -149,14 +550,16 @@ func (ps PermissionSet) Copy() PermissionSet {
 }
 
 // An implication represents a permission which can be implied by a condition
-// (that is, by another permission).
+// (that is, by another permission), or by a combination of conditions.
 //
 // If the Condition is met, ImpliedPermission is implied. The ImpliedPermission will be
 // merged with the PermissionSet, which means that ImpliedPermission will only raise the
 // level of that permission, not lower it.
 type Implication struct {
-	// The Condition which must be met in order for the Implication to apply.
-	Condition Condition
+	// The condition which must be met in order for the Implication to apply.
+	// This is usually a single Condition, but may be any expression. An
+	// implication whose condition is malformed (see CheckExpr) never applies.
+	Condition Expr
 
 	// The Permission which is merged with a PermissionSet if the Implication
 	// applies.
@@ -166,7 +569,7 @@ type Implication struct {
 // Returns a string representation of the implication in the form "condition =>
 // implied-permission", e.g. "foo(5) => bar(10)".
 func (impl *Implication) String() string {
-	return impl.Condition.String() + " => " + impl.ImpliedPermission.String()
+	return exprString(impl.Condition) + " => " + impl.ImpliedPermission.String()
 }
 
 // A set of implications.
@@ -1,7 +1,10 @@
 package perm
 
 import "testing"
+import "time"
 import "reflect"
+import "fmt"
+import "strings"
 
 type test struct {
 	In     string
@@ -68,4 +71,605 @@ func TestParse(t *testing.T) {
 			t.Fatalf("strings did not equal: got %#v, expected %#v", s, tst.OutStr)
 		}
 	}
+
+	for s, line := range map[string]int{
+		"a(1) b(1)":                           1,
+		"a(1) => b(1)\n\n# comment\nc(1) => ": 4,
+		"a(1) => b(1), c(1) => d(1) e(1)":     1,
+		"a(1) => b(1)\n  a(1) AND => b(1)":    2,
+	} {
+		_, err := ParseImplications(s)
+		if err == nil || !strings.HasPrefix(err.Error(), fmt.Sprintf("line %d: ", line)) {
+			t.Fatalf("%q: expected error at line %d, got %v", s, line, err)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	ps := PermissionSet{"a": Permission{Name: "a", Level: 1}}
+	ps.Merge(Permission{Name: "a", Level: 5})
+	ps.Merge(Permission{Name: "a", Level: 2})
+	if ps["a"].Level != 5 {
+		t.Fatalf("merge did not raise level: %v", ps)
+	}
+}
+
+func TestClosure(t *testing.T) {
+	is, err := ParseImplications(`b(1) => c(1), c(1) => d(3), a(1) => b(1), x(0) => y(1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := NewImplicationIndex(is)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := PermissionSet{
+		"a": Permission{Name: "a", Level: 1},
+		"b": Permission{Name: "b", Level: 1},
+		"c": Permission{Name: "c", Level: 1},
+		"d": Permission{Name: "d", Level: 3},
+		"y": Permission{Name: "y", Level: 1},
+	}
+
+	ps := PermissionSet{"a": Permission{Name: "a", Level: 1}}
+	ps.ApplyImplications(is)
+	if !reflect.DeepEqual(ps, expected) {
+		t.Fatalf("unexpected closure: %v", ps)
+	}
+
+	ps = PermissionSet{"a": Permission{Name: "a", Level: 1}}
+	idx.Apply(ps)
+	if !reflect.DeepEqual(ps, expected) {
+		t.Fatalf("unexpected closure: %v", ps)
+	}
+}
+
+func TestCycle(t *testing.T) {
+	is, err := ParseImplications(`a(1) => b(1), b(1) => c(1), c(2) => a(1), x(1) => a(1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewImplicationIndex(is)
+	ce, ok := err.(*CycleError)
+	if !ok || !reflect.DeepEqual(ce.Cycle, []string{"a", "b", "c", "a"}) {
+		t.Fatalf("cycle not detected: %v", err)
+	}
+
+	if cycle := is[:2].FindCycle(); cycle != nil {
+		t.Fatalf("spurious cycle: %v", cycle)
+	}
+
+	// An implication may imply a wildcard which grants its own condition.
+	for _, s := range []string{"project:7:owner(1) => project:7:*(1)", "root(1) => *(1)"} {
+		is, err := ParseImplications(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cycle := is.FindCycle(); cycle != nil {
+			t.Fatalf("%q: spurious cycle: %v", s, cycle)
+		}
+	}
+
+	is, err = ParseImplications("a:x(1) => b(1), b(1) => a:*(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cycle := is.FindCycle(); !reflect.DeepEqual(cycle, []string{"b", "a:*", "b"}) {
+		t.Fatalf("cycle through wildcard not detected: %v", cycle)
+	}
+
+	// ... but not one which would make its own condition false.
+	for _, s := range []string{"NOT root(1) => *(1)", "root(<=0) => *(1)"} {
+		is, err := ParseImplications(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cycle := is.FindCycle(); !reflect.DeepEqual(cycle, []string{"*", "*"}) {
+			t.Fatalf("%q: cycle not detected: %v", s, cycle)
+		}
+	}
+}
+
+func TestNonMonotoneClosure(t *testing.T) {
+	// Conditions which could become false are evaluated only once the
+	// permissions they depend on are final, whatever the order.
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, s := range []string{
+		"NOT banned(1) => can-access(1)\nspammer(1) => banned(1)",
+		"spammer(1) => banned(1)\nNOT banned(1) => can-access(1)",
+		"spammer(1) => strikes(3)\nstrikes(0..2) AND NOT banned(1) => can-access(1)\nstrikes(3) => banned(1)",
+	} {
+		is, err := ParseImplications(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		idx, err := NewImplicationIndex(is)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ps := PermissionSet{"spammer": Permission{Name: "spammer", Level: 1}}
+		idx.ApplyAt(ps, now)
+		if _, ok := ps["can-access"]; ok || ps["banned"].Level != 1 {
+			t.Fatalf("%q: unexpected closure: %v", s, ps)
+		}
+
+		ps = PermissionSet{"user": Permission{Name: "user", Level: 1}}
+		ps.ApplyImplicationsAt(is, now)
+		if ps["can-access"].Level != 1 {
+			t.Fatalf("%q: unexpected closure: %v", s, ps)
+		}
+	}
+}
+
+func TestConditionSyntax(t *testing.T) {
+	conds := []struct {
+		In  string
+		Out string
+		C   Condition
+	}{
+		{"a(5)", "a(5)", Condition{Name: "a", MinLevel: 5}},
+		{"a(>=5)", "a(5)", Condition{Name: "a", MinLevel: 5}},
+		{"a(-1)", "a(-1)", Condition{Name: "a", MinLevel: -1}},
+		{"a(<=-1)", "a(<=-1)", Condition{Name: "a", MinLevel: -1, Op: OpLE}},
+		{"a(==2)", "a(==2)", Condition{Name: "a", MinLevel: 2, Op: OpEQ}},
+		{"a(!=0)", "a(!=0)", Condition{Name: "a", MinLevel: 0, Op: OpNE}},
+		{"a(-2..3)", "a(-2..3)", Condition{Name: "a", MinLevel: -2, Op: OpRange, MaxLevel: 3}},
+	}
+
+	for _, tst := range conds {
+		c, err := ParseCondition(tst.In)
+		if err != nil {
+			t.Fatalf("error parsing %q: %v", tst.In, err)
+		}
+		if c != tst.C {
+			t.Fatalf("%q: got %#v, expected %#v", tst.In, c, tst.C)
+		}
+		if s := c.String(); s != tst.Out {
+			t.Fatalf("%q: got string %q, expected %q", tst.In, s, tst.Out)
+		}
+		c2, err := ParseCondition(c.String())
+		if err != nil || c2 != c {
+			t.Fatalf("%q did not round-trip: %#v, %v", tst.In, c2, err)
+		}
+	}
+
+	for _, s := range []string{"a()", "a(--1)", "a(<1)", "a(3..1)", "a(>=1..2)", "a(1..)"} {
+		if _, err := ParseCondition(s); err == nil {
+			t.Fatalf("invalid condition %q parsed", s)
+		}
+	}
+
+	p, err := ParsePermission("can-access(-1)")
+	if err != nil || p.Level != -1 || p.String() != "can-access(-1)" {
+		t.Fatalf("negative permission: %v, %v", p, err)
+	}
+
+	ps := PermissionSet{"can-access": p}
+	for s, expected := range map[string]bool{
+		"can-access(0)":     false,
+		"can-access(<=-1)":  true,
+		"can-access(-3..0)": true,
+		"can-access(!=-1)":  false,
+		"other(==0)":        true,
+	} {
+		c, _ := ParseCondition(s)
+		if ps.Meets(c) != expected {
+			t.Fatalf("%q: expected %v", s, expected)
+		}
+	}
+}
+
+type ownedObject struct {
+	owner int
+}
+
+func (o *ownedObject) PermOwner() (interface{}, bool) {
+	return o.owner, true
+}
+
+func TestExpr(t *testing.T) {
+	exprs := []struct {
+		In, Out string
+	}{
+		{"a(1)", "a(1)"},
+		{"admin(1) OR (moderator(1) AND verified(1))", "admin(1) OR moderator(1) AND verified(1)"},
+		{"(a(1) OR b(1)) AND NOT c(<=0)", "(a(1) OR b(1)) AND NOT c(<=0)"},
+		{"NOT (a(1) AND b(1)) OR NOT NOT c(1)", "NOT (a(1) AND b(1)) OR NOT NOT c(1)"},
+		{"(a(1) AND b(1)) AND c(1)", "(a(1) AND b(1)) AND c(1)"},
+	}
+
+	for _, tst := range exprs {
+		e, err := ParseExpr(tst.In)
+		if err != nil {
+			t.Fatalf("error parsing %q: %v", tst.In, err)
+		}
+		if s := e.String(); s != tst.Out {
+			t.Fatalf("%q: got string %q, expected %q", tst.In, s, tst.Out)
+		}
+		e2, err := ParseExpr(e.String())
+		if err != nil || !reflect.DeepEqual(e, e2) {
+			t.Fatalf("%q did not round-trip: %v, %v", tst.In, e2, err)
+		}
+	}
+
+	for _, s := range []string{"", "a(1) OR", "(a(1)", "a(1) AND AND b(1)", "NOTa(1)", "a(1) b(1)"} {
+		if _, err := ParseExpr(s); err == nil {
+			t.Fatalf("invalid expression %q parsed", s)
+		}
+	}
+
+	e, _ := ParseExpr("admin(1) OR (moderator(1) AND verified(1))")
+	ps := PermissionSet{"moderator": Permission{Name: "moderator", Level: 1}}
+	if e.Eval(ps) {
+		t.Fatalf("expression unexpectedly satisfied")
+	}
+	ps.Merge(Permission{Name: "verified", Level: 1})
+	if !e.Eval(ps) {
+		t.Fatalf("expression not satisfied")
+	}
+
+	is, err := ParseImplications("moderator(1) AND NOT banned(1) => can-post(1), b(1) => banned(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.ApplyImplications(is)
+	if !ps.Positive("can-post") {
+		t.Fatalf("implication with expression not applied: %v", ps)
+	}
+}
+
+func TestMalformedExpr(t *testing.T) {
+	if s := (&Implication{}).String(); s != "<nil> => (0)" {
+		t.Fatalf("unexpected string: %q", s)
+	}
+
+	ps := PermissionSet{"a": Permission{Name: "a", Level: 1}}
+	for _, e := range []Expr{And{}, Or{}, Not{}, Not{And{}}, Or{Condition{Name: "a", MinLevel: 1}, nil}} {
+		if CheckExpr(e) == nil {
+			t.Fatalf("malformed expression accepted: %v", e)
+		}
+		if e.String() == "" || e.Eval(ps) {
+			t.Fatalf("malformed expression: got string %q, met %v", e.String(), e.Eval(ps))
+		}
+
+		is := ImplicationSet{{Condition: e, ImpliedPermission: Permission{Name: "admin", Level: 1}}}
+		if _, err := NewImplicationIndex(is); err == nil {
+			t.Fatalf("implication with malformed condition compiled: %v", is)
+		}
+		ps2 := ps.Copy()
+		ps2.ApplyImplications(is)
+		if _, ok := ps2["admin"]; ok {
+			t.Fatalf("implication with malformed condition applied: %v", is)
+		}
+		if ex := Explain(ps, is, e); ex.Met || len(ex.Missing) != 1 {
+			t.Fatalf("unexpected explanation: %v", ex)
+		}
+
+		p := &VerbPolicy{Verbs: map[string]Expr{"view": e}}
+		if p.AllowsVerbObj("view", ps, nil) {
+			t.Fatalf("verb with malformed expression allowed: %v", e)
+		}
+	}
+}
+
+func TestVerbPolicy(t *testing.T) {
+	e, err := ParseExpr("owner(1) OR admin(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &VerbPolicy{Verbs: map[string]Expr{"edit": e}}
+	ps := PermissionSet{"user-id:42": Permission{Name: "user-id:42", Level: 1}}
+	if !p.AllowsVerbObj("edit", ps, &ownedObject{42}) {
+		t.Fatalf("owner denied")
+	}
+	if p.AllowsVerbObj("edit", ps, &ownedObject{43}) || p.AllowsVerbObj("edit", ps, nil) {
+		t.Fatalf("non-owner allowed")
+	}
+
+	ps.Merge(Permission{Name: "admin", Level: 1})
+	if !p.AllowsVerbObj("edit", ps, &ownedObject{43}) {
+		t.Fatalf("admin denied")
+	}
+	if p.AllowsVerbObj("delete", ps, nil) {
+		t.Fatalf("default condition not applied")
+	}
+
+	// Without an owner, verbs referring to ownership are denied outright, even
+	// where ownership is negated or only one alternative.
+	e, err = ParseExpr("NOT owner(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Verbs["report"] = e
+	if !p.AllowsVerbObj("report", ps, &ownedObject{43}) || p.AllowsVerbObj("report", ps, &ownedObject{42}) {
+		t.Fatalf("negated ownership not applied")
+	}
+	for _, obj := range []interface{}{nil, struct{}{}} {
+		if p.AllowsVerbObj("report", ps, obj) || p.AllowsVerbObj("edit", ps, obj) {
+			t.Fatalf("verb referring to ownership allowed without an owner: %v", obj)
+		}
+	}
+}
+
+func TestWildcard(t *testing.T) {
+	ps := PermissionSet{}
+	for _, s := range []string{"project:*(2)", "project:7:*(0)", "project:7:admin(3)", "admin.*(1)"} {
+		p, err := ParsePermission(s)
+		if err != nil {
+			t.Fatalf("error parsing %q: %v", s, err)
+		}
+		ps.Merge(p)
+	}
+
+	for name, level := range map[string]int{
+		"project:1:edit":     2,
+		"project:7:edit":     0,
+		"project:7:admin":    3,
+		"project:7":          2,
+		"project":            0,
+		"admin.users.delete": 1,
+		"admin":              0,
+		"admin.*":            1,
+		"project:7:*":        0,
+		"other.*":            0,
+	} {
+		p, _ := ps.Lookup(name)
+		if p.Level != level {
+			t.Fatalf("%q: got level %v, expected %v", name, p.Level, level)
+		}
+	}
+
+	for _, s := range []string{"a*(1)", "a.*.b(1)", "**(1)", "a.b*(1)"} {
+		if _, err := ParsePermission(s); err == nil {
+			t.Fatalf("invalid wildcard %q parsed", s)
+		}
+	}
+
+	is, err := ParseImplications("admin.*(1) => project:*(1), project:3:edit(1) => editor(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps = PermissionSet{"admin.root": Permission{Name: "admin.root", Level: 1}}
+	ps.ApplyImplications(is)
+	if ps.Positive("editor") {
+		t.Fatalf("implication applied without wildcard: %v", ps)
+	}
+	ps.Merge(Permission{Name: "admin.*", Level: 1})
+	ps.ApplyImplications(is)
+	if !ps.Positive("editor") {
+		t.Fatalf("implication through wildcard not applied: %v", ps)
+	}
+
+	is, _ = ParseImplications("project:1:edit(1) => project:1:admin(1), project:1:admin(1) => project:*(1)")
+	if cycle := is.FindCycle(); cycle == nil {
+		t.Fatalf("cycle through wildcard not detected")
+	}
+
+	e, _ := ParseExpr("editor(1)")
+	p := &VerbPolicy{Verbs: map[string]Expr{"project.*": e, "project.view": Condition{Name: "viewer", MinLevel: 1}}}
+	if !p.AllowsVerbObj("project.delete", ps, nil) || p.AllowsVerbObj("project.view", ps, nil) {
+		t.Fatalf("wildcard verb not applied")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	is, err := ParseImplications(`b(2) AND c(1) => d(1)
+    x(1) => y(1)
+    a(1) => c(1)
+    q(1) OR a(1) => r(1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps := PermissionSet{
+		"a": Permission{Name: "a", Level: 1},
+		"b": Permission{Name: "b", Level: 2},
+		"z": Permission{Name: "z", Level: 1},
+	}
+
+	cond, _ := ParseExpr("d(1)")
+	e := Explain(ps, is, cond)
+	expected := "# met: d(1)\n# base: a(1), b(2)\na(1) => c(1)\nb(2) AND c(1) => d(1)\n"
+	if !e.Met || e.String() != expected {
+		t.Fatalf("unexpected explanation:\n%v", e)
+	}
+
+	steps, err := ParseImplications(e.String())
+	if err != nil || !reflect.DeepEqual(steps, e.Steps) {
+		t.Fatalf("explanation did not parse: %v, %v", steps, err)
+	}
+
+	cond, _ = ParseExpr("r(1) AND (y(1) OR NOT z(1))")
+	e = Explain(ps, is, cond)
+	expected = "# not met: r(1) AND (y(1) OR NOT z(1))\n# base: a(1)\n# missing: y(1), NOT z(1)\nq(1) OR a(1) => r(1)\n"
+	if e.Met || e.String() != expected {
+		t.Fatalf("unexpected explanation:\n%v", e)
+	}
+
+	if len(ps) != 3 {
+		t.Fatalf("permission set modified")
+	}
+}
+
+func TestParseVerbPolicies(t *testing.T) {
+	vps, err := ParseVerbPolicies(`# top-level verbs
+view = view(1)
+
+[document]
+edit = owner(1) OR (editor(1) AND NOT suspended(1))  # owners may always edit
+admin.* = admin(>=2)
+
+[empty]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "view = view(1)\n\n[document]\nadmin.* = admin(2)\nedit = owner(1) OR editor(1) AND NOT suspended(1)\n\n[empty]\n"
+	if s := vps.String(); s != expected {
+		t.Fatalf("unexpected string: %q", s)
+	}
+
+	vps2, err := ParseVerbPolicies(vps.String())
+	if err != nil || !reflect.DeepEqual(vps, vps2) {
+		t.Fatalf("policies did not round-trip: %v, %v", vps2, err)
+	}
+
+	ps := PermissionSet{"user-id:1": Permission{Name: "user-id:1", Level: 1}}
+	if !vps["document"].AllowsVerbObj("edit", ps, &ownedObject{1}) {
+		t.Fatalf("owner denied")
+	}
+
+	for s, line := range map[string]int{
+		"view = view(1)\n[bad section\n": 2,
+		"\n\nview view(1)":               3,
+		"[a]\nview = x(1)\nview = y(1)":  3,
+		"[a]\n[a]":                       2,
+		"view = view(1) AND":             1,
+		"# comment\nview* = view(1)":     2,
+	} {
+		_, err := ParseVerbPolicies(s)
+		if err == nil || !strings.HasPrefix(err.Error(), fmt.Sprintf("line %d: ", line)) {
+			t.Fatalf("%q: expected error at line %d, got %v", s, line, err)
+		}
+	}
+}
+
+type policyObject struct {
+	policy Policy
+}
+
+func (o *policyObject) PermPolicy() Policy {
+	return o.policy
+}
+
+// A policy other than a VerbPolicy, which evaluates validity at the current
+// time.
+type onCallPolicy struct{}
+
+func (onCallPolicy) AllowsVerbObj(verb string, ps PermissionSet, obj interface{}) bool {
+	return ps.Positive("on-call")
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	ps := PermissionSet{
+		"on-call": Permission{Name: "on-call", Level: 1, NotAfter: now.Add(time.Hour)},
+		"trial":   Permission{Name: "trial", Level: 1, NotAfter: now.Add(2 * time.Hour)},
+		"staff":   Permission{Name: "staff", Level: 1},
+		"later":   Permission{Name: "later", Level: 1, NotBefore: now.Add(time.Hour)},
+	}
+
+	if !ps.MeetsAt(Condition{Name: "on-call", MinLevel: 1}, now) || ps.MeetsAt(Condition{Name: "later", MinLevel: 1}, now) {
+		t.Fatalf("validity windows not applied")
+	}
+	if !ps.HasAt("on-call", 1, now) || ps.PositiveAt("on-call", now.Add(time.Hour)) ||
+		ps.HasAt("later", 1, now) || !ps.PositiveAt("later", now.Add(time.Hour)) {
+		t.Fatalf("validity windows not applied")
+	}
+
+	// Policies evaluate validity at the given time, whatever their type.
+	for _, p := range []Policy{
+		&VerbPolicy{Verbs: map[string]Expr{"page": Condition{Name: "on-call", MinLevel: 1}}},
+		onCallPolicy{},
+	} {
+		obj := &policyObject{p}
+		if !ps.AllowsVerbObjAt("page", obj, now) || ps.AllowsVerbObjAt("page", obj, now.Add(time.Hour)) {
+			t.Fatalf("%T: validity windows not applied", p)
+		}
+	}
+	if !ps.AllowsVerbObjAt("trial", nil, now) || ps.AllowsVerbObjAt("trial", nil, now.Add(2*time.Hour)) {
+		t.Fatalf("validity windows not applied")
+	}
+
+	is, err := ParseImplications(`on-call(1) AND trial(1) => admin(10)
+    staff(1) => admin(1)
+    trial(1) OR staff(1) => feature(1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps2 := ps.Copy()
+	ps2.ApplyImplicationsAt(is, now)
+	if a := ps2["admin"]; a.Level != 10 || !a.NotAfter.Equal(now.Add(time.Hour)) {
+		t.Fatalf("tightest expiry not propagated: %#v", a)
+	}
+	if f := ps2["feature"]; !f.NotAfter.IsZero() {
+		t.Fatalf("expiry propagated through satisfied alternative: %#v", f)
+	}
+
+	now = now.Add(time.Hour)
+	if ps2.MeetsAt(Condition{Name: "admin", MinLevel: 10}, now) ||
+		ps2.MeetsAt(Condition{Name: "on-call", MinLevel: 1}, now) ||
+		!ps2.MeetsAt(Condition{Name: "later", MinLevel: 1}, now) {
+		t.Fatalf("expiry not applied: %v", ps2)
+	}
+
+	ps.ApplyImplicationsAt(is, now)
+	if _, ok := ps["on-call"]; ok {
+		t.Fatalf("expired permission not pruned")
+	}
+	if a := ps["admin"]; a.Level != 1 || !a.NotAfter.IsZero() {
+		t.Fatalf("unexpected permission after expiry: %#v", a)
+	}
+
+	now = now.Add(time.Hour)
+	ps.PruneAt(now)
+	if _, ok := ps["trial"]; ok || len(ps) != 4 {
+		t.Fatalf("expired permission not pruned: %v", ps)
+	}
+}
+
+func TestTemporaryElevation(t *testing.T) {
+	// A derived elevation does not replace the permanent grant.
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	ps := PermissionSet{
+		"staff":   Permission{Name: "staff", Level: 1},
+		"on-call": Permission{Name: "on-call", Level: 1, NotAfter: now.Add(time.Hour)},
+	}
+	is, err := ParseImplications("on-call(1) => staff(5), staff(1) => canteen(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.ApplyImplicationsAt(is, now)
+	if !ps.HasAt("staff", 5, now) {
+		t.Fatalf("elevation not applied: %v", ps)
+	}
+	if c := ps["canteen"]; !c.NotAfter.IsZero() {
+		t.Fatalf("expiry propagated although permanent grant meets condition: %#v", c)
+	}
+
+	now = now.Add(time.Hour)
+	if ps.HasAt("staff", 5, now) || !ps.HasAt("staff", 1, now) || !ps.HasAt("canteen", 1, now) {
+		t.Fatalf("permanent grant lost after elevation expired: %v", ps)
+	}
+	ps.PruneAt(now)
+	if s := ps["staff"]; s != (Permission{Name: "staff", Level: 1}) {
+		t.Fatalf("unexpected permission after pruning: %#v", s)
+	}
+
+	// Nor does a merged one.
+	ps = PermissionSet{"admin": Permission{Name: "admin", Level: 1}}
+	ps.MergeAt(Permission{Name: "admin", Level: 5, NotAfter: now.Add(time.Hour)}, now)
+	ps.MergeAt(Permission{Name: "admin", Level: 3, NotAfter: now.Add(30 * time.Minute)}, now) // redundant
+	if a := ps["admin"]; !ps.HasAt("admin", 5, now) || a.Level != 5 || a.Grants == nil || len(*a.Grants) != 1 {
+		t.Fatalf("elevation not applied: %#v", a)
+	}
+
+	now = now.Add(time.Hour)
+	if ps.HasAt("admin", 2, now) || !ps.HasAt("admin", 1, now) {
+		t.Fatalf("permanent grant lost after elevation expired: %v", ps)
+	}
+
+	// A permanent grant at a higher level makes the others redundant.
+	ps.MergeAt(Permission{Name: "admin", Level: 5}, now)
+	if a := ps["admin"]; a != (Permission{Name: "admin", Level: 5}) {
+		t.Fatalf("redundant grants kept: %#v", a)
+	}
 }
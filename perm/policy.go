@@ -1,5 +1,7 @@
 package perm
 
+import "time"
+
 // Policy represents a policy which may be nominated by objects under access
 // control. It can authorize or deny an action based on the actor (permission
 // set), object (if specified) and the verb being performed.
@@ -32,14 +34,23 @@ type Ownable interface {
 // Otherwise, condition VERB(1) is checked for, where VERB is the verb name
 // given.
 func (ps PermissionSet) AllowsVerbObj(verb string, obj Object) bool {
+	return ps.AllowsVerbObjAt(verb, obj, time.Now())
+}
+
+// Like AllowsVerbObj, but evaluates the validity of permissions at the given
+// time. A policy which is not a *VerbPolicy is passed the permissions which
+// are valid at that time, without their validity windows.
+func (ps PermissionSet) AllowsVerbObjAt(verb string, obj Object, t time.Time) bool {
 	if obj == nil {
-		return ps.Has(verb, 1)
+		return ps.HasAt(verb, 1, t)
 	}
 
-	policy := obj.PermPolicy()
-	if policy == nil {
-		return ps.Has(verb, 1)
+	switch policy := obj.PermPolicy().(type) {
+	case nil:
+		return ps.HasAt(verb, 1, t)
+	case *VerbPolicy:
+		return policy.AllowsVerbObjAt(verb, ps, obj, t)
+	default:
+		return policy.AllowsVerbObj(verb, ps.snapshotAt(t), obj)
 	}
-
-	return policy.AllowsVerbObj(verb, ps, obj)
 }
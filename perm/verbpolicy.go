@@ -1,19 +1,29 @@
 package perm
 
+import "bytes"
 import "fmt"
+import "sort"
+import "time"
 
-// A simple policy based on mapping verb names to conditions.
+// A simple policy based on mapping verb names to conditions. Each condition
+// may be a single Condition or any expression.
 //
-// If a verb is not specified in the map, the condition VERB(1) is used,
-// where VERB is the verb name.
+// Verb names may be hierarchical, and the map may contain wildcard entries
+// such as "project.*", which apply to every verb beneath them. The most
+// specific entry applies, using the same rule as PermissionSet.Lookup. If no
+// entry applies, the condition VERB(1) is used, where VERB is the verb name.
 //
-// Also supports ownership semantics: if a verb nominates a condition with name
-// "owner", that condition is substituted for a condition
+// Also supports ownership semantics: if a verb's expression contains a
+// condition with name "owner", that condition is substituted for a condition
 // "user-id:OWNER-ID(1)", where OWNER-ID is string form of the the owner ID of
 // the object being accessed. If no object is specified, or the object does not
-// express an owner, ownership-based checks fail.
+// express an owner, any verb whose expression refers to ownership is denied,
+// even if the ownership condition is negated or is only one alternative of an
+// OR.
+//
+// A verb whose expression is malformed (see CheckExpr) is always denied.
 type VerbPolicy struct {
-	Verbs map[string]Condition // verb name -> Condition
+	Verbs map[string]Expr // verb name -> condition expression
 }
 
 // Returns true iff the policy allows the given verb to be carried out given
@@ -26,24 +36,108 @@ type VerbPolicy struct {
 // every user the permission "user-id:USER-ID(1)", where USER-ID is their user
 // ID.)
 //
-// obj may be nil, in which case owner-based checks fail.
+// obj may be nil, in which case verbs which refer to ownership are denied.
 func (p *VerbPolicy) AllowsVerbObj(verb string, ps PermissionSet, obj interface{}) bool {
-	c, ok := p.Verbs[verb]
+	return p.AllowsVerbObjAt(verb, ps, obj, time.Now())
+}
+
+// Like AllowsVerbObj, but evaluates the validity of permissions at the given
+// time.
+func (p *VerbPolicy) AllowsVerbObjAt(verb string, ps PermissionSet, obj interface{}, t time.Time) bool {
+	e, ok := p.lookup(verb)
 	if !ok {
-		c = Condition{Name: verb, MinLevel: 1}
+		e = Condition{Name: verb, MinLevel: 1}
+	}
+	if CheckExpr(e) != nil {
+		return false
+	}
+
+	ownerName := ""
+	if oo, ok := obj.(Ownable); ok {
+		if ownerID, ok := oo.PermOwner(); ok {
+			ownerName = fmt.Sprintf("user-id:%v", ownerID)
+		}
+	}
+
+	usesOwner := false
+	e.walk(func(c Condition) {
+		if c.Name == "owner" {
+			usesOwner = true
+		}
+	})
+	if !usesOwner {
+		return EvalAt(e, ps, t)
+	}
+	if ownerName == "" {
+		return false
+	}
+
+	e = mapExpr(e, func(c Condition) Expr {
+		if c.Name == "owner" {
+			c.Name = ownerName
+		}
+		return c
+	})
+
+	return EvalAt(e, ps, t)
+}
+
+// Returns the most specific entry applying to the verb, if any.
+func (p *VerbPolicy) lookup(verb string) (Expr, bool) {
+	for _, k := range grantingNames(verb) {
+		if e, ok := p.Verbs[k]; ok {
+			return e, true
+		}
+	}
+
+	return nil, false
+}
+
+// Returns the policy in the textual form accepted by ParseVerbPolicies, with
+// one "verb = condition" line per verb, ordered by verb.
+func (p *VerbPolicy) String() string {
+	var verbs []string
+	for verb := range p.Verbs {
+		verbs = append(verbs, verb)
 	}
+	sort.Strings(verbs)
 
-	if c.Name == "owner" {
-		oo, ok := obj.(Ownable)
-		if !ok {
-			return false
+	var buf bytes.Buffer
+	for _, verb := range verbs {
+		fmt.Fprintf(&buf, "%s = %v\n", verb, p.Verbs[verb])
+	}
+	return buf.String()
+}
+
+// A set of named verb policies, as loaded from a policy file. Verbs which
+// appear in a policy file before any section header belong to the policy
+// named "".
+type VerbPolicySet map[string]*VerbPolicy
+
+// Returns the policies in the textual form accepted by ParseVerbPolicies. The
+// policy named "" comes first, followed by the other policies ordered by
+// name.
+func (vps VerbPolicySet) String() string {
+	var names []string
+	for name := range vps {
+		if name != "" {
+			names = append(names, name)
 		}
-		ownerID, ok := oo.PermOwner()
-		if !ok {
-			return false
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	if p, ok := vps[""]; ok {
+		buf.WriteString(p.String())
+	}
+
+	for _, name := range names {
+		if buf.Len() > 0 {
+			buf.WriteString("\n")
 		}
-		c.Name = fmt.Sprintf("user-id:%v", ownerID)
+		fmt.Fprintf(&buf, "[%s]\n", name)
+		buf.WriteString(vps[name].String())
 	}
 
-	return ps.Meets(c)
+	return buf.String()
 }
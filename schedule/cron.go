@@ -0,0 +1,250 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Schedule determines when a job runs.
+type Schedule interface {
+	// Returns the first activation time after t. Returns the zero time if the
+	// schedule will never activate again.
+	Next(t time.Time) time.Time
+}
+
+// Returns a schedule which activates at a fixed interval.
+func Every(interval time.Duration) Schedule {
+	if interval <= 0 {
+		panic("non-positive interval for Every")
+	}
+
+	return everySchedule(interval)
+}
+
+type everySchedule time.Duration
+
+func (s everySchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+func (s everySchedule) String() string {
+	return "@every " + time.Duration(s).String()
+}
+
+// A schedule expressed as a cron expression.
+type cronSchedule struct {
+	expr                          string
+	minute, hour, dom, month, dow uint64
+	domRestricted, dowRestricted  bool
+}
+
+type cronField struct {
+	min, max int
+	names    []string
+}
+
+var cronFields = []cronField{
+	{0, 59, nil},
+	{0, 23, nil},
+	{1, 31, nil},
+	{1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+var cronAliases = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parses a cron expression.
+//
+// The standard five-field form "minute hour day-of-month month day-of-week"
+// is supported. Each field may be "*", a number, a range "a-b", or a list of
+// these separated by commas; "*" and ranges may be followed by a step "/n".
+// Months and days of the week may be given as three-letter English names.
+// Day-of-week 0 and 7 are both Sunday. As in cron, if both day-of-month and
+// day-of-week are restricted, a day matching either field matches.
+//
+// The aliases @yearly, @annually, @monthly, @weekly, @daily, @midnight and
+// @hourly are accepted, as is "@every DURATION", which is equivalent to
+// Every(DURATION).
+//
+// Times are evaluated in the location of the time passed to Next.
+func ParseCron(expr string) (Schedule, error) {
+	e := strings.TrimSpace(expr)
+	if strings.HasPrefix(e, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(e[7:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %#v: %v", expr, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid cron expression %#v: interval must be positive", expr)
+		}
+
+		return Every(d), nil
+	}
+
+	if alias, ok := cronAliases[e]; ok {
+		e = alias
+	}
+
+	fields := strings.Fields(e)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid cron expression %#v: expected %d fields, got %d", expr, len(cronFields), len(fields))
+	}
+
+	var masks [5]uint64
+	for i, f := range fields {
+		m, err := parseCronField(f, &cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %#v: %v", expr, err)
+		}
+
+		masks[i] = m
+	}
+
+	// Day-of-week 7 is Sunday.
+	if masks[4]&(1<<7) != 0 {
+		masks[4] = (masks[4] | 1) &^ (1 << 7)
+	}
+
+	return &cronSchedule{
+		expr:          expr,
+		minute:        masks[0],
+		hour:          masks[1],
+		dom:           masks[2],
+		month:         masks[3],
+		dow:           masks[4],
+		domRestricted: fields[2] != "*",
+		dowRestricted: fields[4] != "*",
+	}, nil
+}
+
+func parseCronField(s string, f *cronField) (mask uint64, err error) {
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, step := f.min, f.max, 1
+		rng := part
+		if idx := strings.IndexByte(part, '/'); idx >= 0 {
+			rng = part[0:idx]
+			step, err = strconv.Atoi(part[idx+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %#v", part)
+			}
+		}
+
+		if rng != "*" {
+			if idx := strings.IndexByte(rng, '-'); idx >= 0 {
+				lo, err = parseCronValue(rng[0:idx], f)
+				if err != nil {
+					return
+				}
+				hi, err = parseCronValue(rng[idx+1:], f)
+				if err != nil {
+					return
+				}
+			} else {
+				lo, err = parseCronValue(rng, f)
+				if err != nil {
+					return
+				}
+				if step == 1 {
+					hi = lo
+				}
+			}
+		}
+
+		if lo > hi {
+			return 0, fmt.Errorf("invalid range %#v", part)
+		}
+
+		for i := lo; i <= hi; i += step {
+			mask |= 1 << uint(i)
+		}
+	}
+
+	return
+}
+
+func parseCronValue(s string, f *cronField) (int, error) {
+	ls := strings.ToLower(s)
+	for i, n := range f.names {
+		if ls == n {
+			return f.min + i, nil
+		}
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %#v out of range %d-%d", s, f.min, f.max)
+	}
+
+	return v, nil
+}
+
+func has(mask uint64, v int) bool {
+	return mask&(1<<uint(v)) != 0
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := has(s.dom, t.Day())
+	dowMatch := has(s.dow, int(t.Weekday()))
+	if s.domRestricted && s.dowRestricted {
+		return domMatch || dowMatch
+	}
+
+	return domMatch && dowMatch
+}
+
+// Searches for the next matching minute. Each field is advanced in turn; when
+// a field wraps, the search restarts from the most significant field.
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc).Add(time.Minute)
+	yearLimit := t.Year() + 5
+
+wrap:
+	if t.Year() > yearLimit {
+		return time.Time{}
+	}
+
+	for !has(s.month, int(t.Month())) {
+		t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		if t.Month() == time.January {
+			goto wrap
+		}
+	}
+
+	for !s.dayMatches(t) {
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		if t.Day() == 1 {
+			goto wrap
+		}
+	}
+
+	for !has(s.hour, t.Hour()) {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		if t.Hour() == 0 {
+			goto wrap
+		}
+	}
+
+	for !has(s.minute, t.Minute()) {
+		t = t.Add(time.Minute)
+		if t.Minute() == 0 {
+			goto wrap
+		}
+	}
+
+	return t
+}
+
+func (s *cronSchedule) String() string {
+	return s.expr
+}
@@ -0,0 +1,294 @@
+// Package schedule provides a job scheduler for periodic maintenance tasks.
+//
+// Jobs run on a fixed interval or according to a cron expression. All timing
+// is done against a clock.Clock, so a scheduler can be driven by a fake clock
+// in tests.
+package schedule
+
+import (
+	"fmt"
+	"github.com/hlandau/degoutils/clock"
+	"golang.org/x/net/context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A job which is run periodically.
+type Job struct {
+	// The job name. Must be unique within a scheduler.
+	Name string
+
+	// Determines when the job runs.
+	Schedule Schedule
+
+	// The function to run. The context is cancelled when the scheduler is
+	// stopped.
+	Func func(ctx context.Context) error
+
+	// If nonzero, each run is delayed by a random duration in [0, Jitter).
+	Jitter time.Duration
+
+	// If false (the default), a run which becomes due while the previous run is
+	// still in progress is skipped.
+	AllowOverlap bool
+}
+
+// Information about a job, as returned by Scheduler.Jobs.
+type JobStatus struct {
+	Name      string
+	Running   int       // Number of runs in progress.
+	LastRun   time.Time // Start time of the last run, or zero if it has never run.
+	LastError error     // The error returned by the last completed run.
+	NextRun   time.Time // Time of the next run, or zero if none is scheduled.
+	Runs      int       // Number of runs started.
+	Skipped   int       // Number of runs skipped due to overlap.
+}
+
+// Scheduler configuration.
+type Config struct {
+	// The clock used for scheduling. Defaults to clock.Real.
+	Clock clock.Clock
+
+	// Source of randomness for jitter. Defaults to a source seeded from the
+	// time.
+	Rand *rand.Rand
+}
+
+// A scheduler runs jobs according to their schedules.
+type Scheduler struct {
+	cfg     Config
+	mutex   sync.Mutex
+	jobs    map[string]*job
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	started bool
+	stopped bool
+
+	// Called after each run has completed and its status has been updated.
+	// For tests.
+	runDone func(j *job)
+}
+
+type job struct {
+	Job
+	status JobStatus
+	timer  clock.Timer
+	due    time.Time // NextRun before jitter is applied
+}
+
+// Creates a new scheduler. Jobs are not run until Start is called.
+func New(cfg Config) *Scheduler {
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real
+	}
+	if cfg.Rand == nil {
+		t := time.Now()
+		cfg.Rand = rand.New(rand.NewSource(t.Unix() ^ t.UnixNano()))
+	}
+
+	return &Scheduler{
+		cfg:  cfg,
+		jobs: map[string]*job{},
+	}
+}
+
+// Adds a job to the scheduler. If the scheduler has been started, the job is
+// scheduled immediately.
+func (s *Scheduler) Add(j Job) error {
+	if j.Name == "" || j.Schedule == nil || j.Func == nil {
+		return fmt.Errorf("job must have a name, schedule and function")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopped {
+		return fmt.Errorf("scheduler has been stopped")
+	}
+	if _, ok := s.jobs[j.Name]; ok {
+		return fmt.Errorf("job %#v already exists", j.Name)
+	}
+
+	jj := &job{Job: j}
+	jj.status.Name = j.Name
+	s.jobs[j.Name] = jj
+	if s.started {
+		s.lSchedule(jj, s.cfg.Clock.Now())
+	}
+
+	return nil
+}
+
+// Removes a job. Runs in progress are not interrupted. Returns false if there
+// is no job with the given name.
+func (s *Scheduler) Remove(name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	j, ok := s.jobs[name]
+	if !ok {
+		return false
+	}
+
+	if j.timer != nil {
+		j.timer.Stop()
+	}
+	delete(s.jobs, name)
+	return true
+}
+
+// Starts scheduling jobs. The scheduler stops when ctx is cancelled or Stop
+// is called, and the contexts passed to running jobs are cancelled. A stopped
+// scheduler cannot be restarted; calling Start again has no effect.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.started || s.stopped {
+		return
+	}
+
+	s.started = true
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	now := s.cfg.Clock.Now()
+	for _, j := range s.jobs {
+		s.lSchedule(j, now)
+	}
+
+	go func() {
+		<-s.ctx.Done()
+		s.stop()
+	}()
+}
+
+// Stops the scheduler and waits for any running jobs to return.
+func (s *Scheduler) Stop() {
+	s.stop()
+	s.wg.Wait()
+}
+
+func (s *Scheduler) stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopped {
+		return
+	}
+
+	s.stopped = true
+	for _, j := range s.jobs {
+		if j.timer != nil {
+			j.timer.Stop()
+		}
+		j.status.NextRun = time.Time{}
+	}
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// Returns the status of all jobs, sorted by name.
+func (s *Scheduler) Jobs() []JobStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var js []JobStatus
+	for _, j := range s.jobs {
+		js = append(js, j.status)
+	}
+
+	sort.Sort(byName(js))
+	return js
+}
+
+// Returns the status of the named job.
+func (s *Scheduler) Job(name string) (JobStatus, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	j, ok := s.jobs[name]
+	if !ok {
+		return JobStatus{}, false
+	}
+
+	return j.status, true
+}
+
+type byName []JobStatus
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// Schedules the next run of a job after the given time. Lock must be held.
+func (s *Scheduler) lSchedule(j *job, after time.Time) {
+	next := j.Schedule.Next(after)
+	if next.IsZero() {
+		j.status.NextRun = time.Time{}
+		return
+	}
+
+	j.due = next
+	if j.Jitter > 0 {
+		next = next.Add(time.Duration(s.cfg.Rand.Int63n(int64(j.Jitter))))
+	}
+
+	j.status.NextRun = next
+	d := next.Sub(s.cfg.Clock.Now())
+	if j.timer == nil {
+		j.timer = s.cfg.Clock.AfterFunc(d, func() {
+			s.fire(j)
+		})
+	} else {
+		j.timer.Reset(d)
+	}
+}
+
+func (s *Scheduler) fire(j *job) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopped || s.jobs[j.Name] != j {
+		return
+	}
+
+	now := s.cfg.Clock.Now()
+	if j.status.Running > 0 && !j.AllowOverlap {
+		j.status.Skipped++
+	} else {
+		j.status.Running++
+		j.status.Runs++
+		j.status.LastRun = now
+		s.wg.Add(1)
+		go s.run(j)
+	}
+
+	// Schedule relative to the due time rather than the time at which the timer
+	// fired, so that fixed intervals don't drift. If that would schedule a run
+	// in the past (e.g. because the system was suspended), skip ahead instead.
+	after := j.due
+	if next := j.Schedule.Next(after); !next.After(now) {
+		after = now
+	}
+	s.lSchedule(j, after)
+}
+
+func (s *Scheduler) run(j *job) {
+	defer s.wg.Done()
+
+	err := j.Func(s.ctx)
+
+	s.mutex.Lock()
+	j.status.Running--
+	j.status.LastError = err
+	runDone := s.runDone
+	s.mutex.Unlock()
+
+	if runDone != nil {
+		runDone(j)
+	}
+}
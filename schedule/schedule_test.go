@@ -0,0 +1,204 @@
+package schedule
+
+import "github.com/hlandau/degoutils/clock"
+import "golang.org/x/net/context"
+import "math/rand"
+import "testing"
+import "time"
+
+var epoch = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC) // a Thursday
+
+type cronTest struct {
+	Expr string
+	From time.Time
+	Next time.Time
+}
+
+var cronTests = []cronTest{
+	{"* * * * *", epoch, epoch.Add(time.Minute)},
+	{"*/15 * * * *", epoch.Add(time.Minute), epoch.Add(15 * time.Minute)},
+	{"30 4 * * *", epoch, time.Date(2015, 1, 1, 4, 30, 0, 0, time.UTC)},
+	{"30 4 * * *", epoch.Add(5 * time.Hour), time.Date(2015, 1, 2, 4, 30, 0, 0, time.UTC)},
+	{"0 0 * * mon", epoch, time.Date(2015, 1, 5, 0, 0, 0, 0, time.UTC)},
+	{"0 0 * * 7", epoch, time.Date(2015, 1, 4, 0, 0, 0, 0, time.UTC)},
+	{"0 0 29 feb *", epoch, time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC)},
+	{"0 0 13 * fri", epoch, time.Date(2015, 1, 2, 0, 0, 0, 0, time.UTC)},
+	{"0 9-17/4 * * 1-5", epoch, time.Date(2015, 1, 1, 9, 0, 0, 0, time.UTC)},
+	{"@monthly", epoch, time.Date(2015, 2, 1, 0, 0, 0, 0, time.UTC)},
+	{"@every 90s", epoch, epoch.Add(90 * time.Second)},
+}
+
+func TestCron(t *testing.T) {
+	for _, tst := range cronTests {
+		s, err := ParseCron(tst.Expr)
+		if err != nil {
+			t.Fatalf("cannot parse %#v: %v", tst.Expr, err)
+		}
+
+		n := s.Next(tst.From)
+		if !n.Equal(tst.Next) {
+			t.Errorf("%#v from %v: got %v, expected %v", tst.Expr, tst.From, n, tst.Next)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "5-1 * * * *", "*/0 * * * *", "@every -1s"} {
+		_, err := ParseCron(expr)
+		if err == nil {
+			t.Errorf("expected error parsing %#v", expr)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	clk := clock.NewSlowAt(epoch)
+	s := New(Config{Clock: clk})
+	done := make(chan struct{}, 10)
+	s.runDone = func(j *job) {
+		done <- struct{}{}
+	}
+
+	runs := make(chan time.Time, 10)
+	release := make(chan struct{})
+	err := s.Add(Job{
+		Name:     "cleanup",
+		Schedule: Every(time.Minute),
+		Func: func(ctx context.Context) error {
+			runs <- clk.Now()
+			<-release
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start(context.Background())
+	js, _ := s.Job("cleanup")
+	if !js.NextRun.Equal(epoch.Add(time.Minute)) {
+		t.Fatalf("unexpected next run: %v", js.NextRun)
+	}
+
+	clk.Advance(time.Minute)
+	if v := <-runs; !v.Equal(epoch.Add(time.Minute)) {
+		t.Fatalf("unexpected run time: %v", v)
+	}
+
+	// The first run is still in progress, so this one is skipped.
+	clk.Advance(time.Minute)
+	js, _ = s.Job("cleanup")
+	if js.Runs != 1 || js.Skipped != 1 || js.Running != 1 {
+		t.Fatalf("unexpected status: %+v", js)
+	}
+	if !js.LastRun.Equal(epoch.Add(time.Minute)) || !js.NextRun.Equal(epoch.Add(3*time.Minute)) {
+		t.Fatalf("unexpected status: %+v", js)
+	}
+
+	release <- struct{}{}
+	<-done
+
+	clk.Advance(time.Minute)
+	<-runs
+	close(release)
+	s.Stop()
+
+	js, _ = s.Job("cleanup")
+	if js.Runs != 2 || js.Running != 0 || !js.NextRun.IsZero() {
+		t.Fatalf("unexpected status after stop: %+v", js)
+	}
+
+	// A stopped scheduler cannot be restarted.
+	s.Start(context.Background())
+	js, _ = s.Job("cleanup")
+	if !js.NextRun.IsZero() || len(clk.PendingSleepers()) != 0 {
+		t.Fatalf("stopped scheduler restarted: %+v", js)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	const jitter = 10 * time.Second
+	clk := clock.NewSlowAt(epoch)
+	s := New(Config{Clock: clk, Rand: rand.New(rand.NewSource(1))})
+	expected := rand.New(rand.NewSource(1))
+
+	runs := make(chan time.Time, 10)
+	err := s.Add(Job{
+		Name:     "report",
+		Schedule: Every(time.Minute),
+		Jitter:   jitter,
+		Func: func(ctx context.Context) error {
+			runs <- clk.Now()
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start(context.Background())
+	defer s.Stop()
+
+	for i := 1; i <= 3; i++ {
+		// Jitter is applied to each due time, and does not accumulate.
+		next := epoch.Add(time.Duration(i)*time.Minute + time.Duration(expected.Int63n(int64(jitter))))
+		js, _ := s.Job("report")
+		if !js.NextRun.Equal(next) {
+			t.Fatalf("run %d: got next run %v, expected %v", i, js.NextRun, next)
+		}
+
+		clk.Advance(next.Sub(clk.Now()) - 1)
+		select {
+		case <-runs:
+			t.Fatalf("run %d: ran before jittered time", i)
+		default:
+		}
+
+		clk.Advance(1)
+		if v := <-runs; !v.Equal(next) {
+			t.Fatalf("run %d: ran at %v, expected %v", i, v, next)
+		}
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	clk := clock.NewSlowAt(epoch)
+	s := New(Config{Clock: clk})
+
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	err := s.Add(Job{
+		Name:     "long",
+		Schedule: Every(time.Minute),
+		Func: func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			cancelled <- ctx.Err()
+			return ctx.Err()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	clk.Advance(time.Minute)
+	<-started
+
+	cancel()
+	if err := <-cancelled; err != context.Canceled {
+		t.Fatalf("unexpected context error: %v", err)
+	}
+
+	s.Stop()
+	js, _ := s.Job("long")
+	if js.Running != 0 || !js.NextRun.IsZero() || js.LastError != context.Canceled {
+		t.Fatalf("unexpected status after cancellation: %+v", js)
+	}
+	if len(clk.PendingSleepers()) != 0 {
+		t.Fatalf("cancelled scheduler still has timers pending")
+	}
+
+	if err := s.Add(Job{Name: "late", Schedule: Every(time.Minute), Func: func(ctx context.Context) error { return nil }}); err == nil {
+		t.Fatalf("job added to stopped scheduler")
+	}
+}
@@ -0,0 +1,256 @@
+package supervise
+
+import "github.com/hlandau/degoutils/monitor"
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+// The state of a supervised child.
+type ChildState int
+
+const (
+	Stopped    ChildState = iota // Not started, or stopped along with its supervisor.
+	Running                      // Currently running.
+	Restarting                   // Exited, and due to be restarted.
+	Exited                       // Exited, and not due to be restarted.
+	GaveUp                       // Exited too often and was not restarted.
+)
+
+func (s ChildState) String() string {
+	switch s {
+	case Stopped:
+		return "stopped"
+	case Running:
+		return "running"
+	case Restarting:
+		return "restarting"
+	case Exited:
+		return "exited"
+	case GaveUp:
+		return "gave up"
+	default:
+		return fmt.Sprintf("ChildState(%d)", int(s))
+	}
+}
+
+// A snapshot of a supervisor and its children.
+type Status struct {
+	Name     string
+	Running  bool
+	Children []ChildStatus
+}
+
+// A snapshot of a supervised child.
+type ChildStatus struct {
+	Name        string
+	State       ChildState
+	Restarts    int
+	StartTime   time.Time      // When the child was last started.
+	LastExit    *monitor.Event // How the child last exited, if it has.
+	NextRestart time.Time      // If the state is Restarting, when the restart is due.
+	Tree        *Status        // If the child is a Tree, its status.
+}
+
+// Supervisors which are running and are not the child of a Tree.
+var registry = struct {
+	mutex       sync.Mutex
+	supervisors map[Supervisor]struct{}
+}{supervisors: map[Supervisor]struct{}{}}
+
+func register(s Supervisor) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.supervisors[s] = struct{}{}
+}
+
+func unregister(s Supervisor) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	delete(registry.supervisors, s)
+}
+
+type statusSorter []Status
+
+func (ss statusSorter) Len() int {
+	return len(ss)
+}
+
+func (ss statusSorter) Less(i, j int) bool {
+	return ss[i].Name < ss[j].Name
+}
+
+func (ss statusSorter) Swap(i, j int) {
+	ss[i], ss[j] = ss[j], ss[i]
+}
+
+// Returns the status of every running top-level supervisor, ordered by name.
+// Trees which are children of other trees are included in the status of
+// their parent.
+func Supervisors() []Status {
+	registry.mutex.Lock()
+	var sups []Supervisor
+	for s := range registry.supervisors {
+		sups = append(sups, s)
+	}
+	registry.mutex.Unlock()
+
+	var ss []Status
+	for _, s := range sups {
+		ss = append(ss, s.Status())
+	}
+
+	sort.Sort(statusSorter(ss))
+	return ss
+}
+
+func init() {
+	http.Handle("/supervise", Handler())
+}
+
+// Returns a handler which describes all running supervisors and their
+// children in plain text, or in JSON form if the request has the query
+// parameter "format=json" or accepts application/json.
+//
+// The handler is registered on http.DefaultServeMux as /supervise, so it is
+// available as /.service-nexus/supervise where the service nexus is in use.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ss := Supervisors()
+		if req.URL.Query().Get("format") == "json" ||
+			strings.Contains(req.Header.Get("Accept"), "application/json") {
+			jsonStatus(rw, ss)
+		} else {
+			textStatus(rw, ss)
+		}
+	})
+}
+
+func textStatus(rw http.ResponseWriter, ss []Status) {
+	var buf bytes.Buffer
+	for _, s := range ss {
+		writeStatus(&buf, &s, "")
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Write(buf.Bytes())
+}
+
+func writeStatus(buf *bytes.Buffer, s *Status, indent string) {
+	name := s.Name
+	if name == "" {
+		name = "(unnamed)"
+	}
+	state := "stopped"
+	if s.Running {
+		state = "running"
+	}
+	fmt.Fprintf(buf, "%s%s: %s\n", indent, name, state)
+
+	indent += "  "
+	for _, c := range s.Children {
+		fmt.Fprintf(buf, "%s%s: %v, %d restarts", indent, c.Name, c.State, c.Restarts)
+		if c.State == Restarting {
+			fmt.Fprintf(buf, ", restarting at %v", c.NextRestart.UTC().Format(time.RFC3339Nano))
+		}
+		buf.WriteString("\n")
+		if c.LastExit != nil {
+			fmt.Fprintf(buf, "%s  last exit at %v: %v\n", indent,
+				c.LastExit.ExitTime.UTC().Format(time.RFC3339Nano), c.LastExit)
+		}
+		if c.Tree != nil {
+			writeStatus(buf, c.Tree, indent+"  ")
+		}
+	}
+}
+
+type jsonSupervisor struct {
+	Name     string      `json:"name"`
+	Running  bool        `json:"running"`
+	Children []jsonChild `json:"children"`
+}
+
+type jsonChild struct {
+	Name        string          `json:"name"`
+	State       string          `json:"state"`
+	Restarts    int             `json:"restarts"`
+	StartTime   string          `json:"start_time,omitempty"`
+	LastExit    *jsonExit       `json:"last_exit,omitempty"`
+	NextRestart string          `json:"next_restart,omitempty"`
+	Tree        *jsonSupervisor `json:"tree,omitempty"`
+}
+
+type jsonExit struct {
+	Type     string  `json:"type"`
+	Time     string  `json:"time"`
+	Duration float64 `json:"duration"` // seconds
+	Error    string  `json:"error,omitempty"`
+	Panic    string  `json:"panic,omitempty"`
+	Stack    string  `json:"stack,omitempty"`
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func toJSON(s *Status) *jsonSupervisor {
+	js := &jsonSupervisor{
+		Name:     s.Name,
+		Running:  s.Running,
+		Children: []jsonChild{},
+	}
+
+	for _, c := range s.Children {
+		jc := jsonChild{
+			Name:      c.Name,
+			State:     c.State.String(),
+			Restarts:  c.Restarts,
+			StartTime: formatTime(c.StartTime),
+		}
+		if c.State == Restarting {
+			jc.NextRestart = formatTime(c.NextRestart)
+		}
+		if e := c.LastExit; e != nil {
+			jc.LastExit = &jsonExit{
+				Type:     e.Type.String(),
+				Time:     formatTime(e.ExitTime),
+				Duration: e.Duration().Seconds(),
+				Stack:    string(e.Stack),
+			}
+			if e.Error != nil {
+				jc.LastExit.Error = e.Error.Error()
+			}
+			if e.Type == monitor.PanicExit {
+				jc.LastExit.Panic = fmt.Sprint(e.Panic)
+			}
+		}
+		if c.Tree != nil {
+			jc.Tree = toJSON(c.Tree)
+		}
+		js.Children = append(js.Children, jc)
+	}
+
+	return js
+}
+
+func jsonStatus(rw http.ResponseWriter, ss []Status) {
+	jss := []*jsonSupervisor{}
+	for i := range ss {
+		jss = append(jss, toJSON(&ss[i]))
+	}
+
+	b, err := json.Marshal(jss)
+	if err != nil {
+		rw.WriteHeader(500)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(b)
+}
@@ -1,61 +1,70 @@
 // WORK IN PROGRESS
 package supervise
 
+import "github.com/hlandau/degoutils/clock"
+import "github.com/hlandau/degoutils/health"
 import "github.com/hlandau/degoutils/log"
+import "github.com/hlandau/degoutils/monitor"
 import "github.com/hlandau/degoutils/net"
+import "golang.org/x/net/context"
 import "fmt"
+import "sync"
 import "time"
 
+// Deprecated: use the equivalent monitor.EventType values.
 const (
-	MET_NormalExit  = 0
-	MET_PanicExit   = 1
-	MET_RuntimeExit = 2
+	MET_NormalExit  = int(monitor.NormalExit)
+	MET_PanicExit   = int(monitor.PanicExit)
+	MET_RuntimeExit = int(monitor.RuntimeExit)
 )
 
+// Deprecated: use monitor.Event, which is available as the Event field.
 type MonitorEvent struct {
 	Type        int
 	PanicValue  interface{}
 	ReturnError error
+
+	// The full event, including the stack trace and timestamps.
+	Event monitor.Event
 }
 
+// Deprecated: use monitor.Monitor.
 func Monitor(f func() error) <-chan MonitorEvent {
-	ch := make(chan MonitorEvent, 10)
+	ch := make(chan MonitorEvent, 1)
 	go func() {
-		var normalExit bool = false
-		var err error
-		defer func() {
-			r := recover()
-			if r != nil {
-				// recover ...
-				ch <- MonitorEvent{MET_PanicExit, r, nil}
-			} else if normalExit {
-				ch <- MonitorEvent{MET_NormalExit, nil, err}
-			} else {
-				ch <- MonitorEvent{MET_RuntimeExit, nil, nil}
-			}
-		}()
-
-		err = f()
-
-		normalExit = true
+		e := <-monitor.Monitor(f)
+		ch <- MonitorEvent{
+			Type:        int(e.Type),
+			PanicValue:  e.Panic,
+			ReturnError: e.Error,
+			Event:       e,
+		}
 	}()
 	return ch
 }
 
-////////////////////
-
 type Supervisor interface {
 	EventChan() <-chan SupervisionEvent
 	Stop()
+
+	// Returns a snapshot of the supervisor and its children.
+	Status() Status
 }
 
 const (
-	SET_NormalExit = 1
-	SET_Stopped    = 2
+	SET_NormalExit     = 1
+	SET_Stopped        = 2
+	SET_ChildExited    = 3 // A child of a Tree exited.
+	SET_ChildRestarted = 4 // A child of a Tree was restarted.
+
+	SET_RestartLimitExceeded = 5 // A child was not restarted because it exited too often.
+	SET_Escalated            = 6 // A Tree terminated itself because a child exceeded its restart limit.
 )
 
 type SupervisionEvent struct {
-	Type int
+	Type  int
+	Child string        // The name of the child concerned, if any.
+	Exit  monitor.Event // For SET_ChildExited and SET_RestartLimitExceeded, how the child exited.
 }
 
 const (
@@ -66,50 +75,246 @@ type SupervisionCommand struct {
 	Type int
 }
 
+// Configuration for SuperviseContext.
+type Config struct {
+	// The name of the supervisor, used in status reports and as the name of
+	// its only child.
+	Name string
+
+	// Restart delays.
+	Backoff net.Backoff
+
+	// If the function has run for at least this long when it exits, the
+	// backoff is reset before the restart delay is determined. If zero, the
+	// backoff is never reset.
+	StablePeriod time.Duration
+
+	// If nonzero, a function which exits abnormally more than MaxRestarts
+	// times within RestartWindow is not restarted again, and
+	// SET_RestartLimitExceeded is emitted. The supervisor then remains idle
+	// until stopped.
+	MaxRestarts   int
+	RestartWindow time.Duration
+
+	// If set, this criterion is decremented when the restart limit is
+	// exceeded.
+	Criterion *health.Criterion
+
+	// How long Stop waits for the function to return after its context is
+	// cancelled. If zero, 10 seconds is used. If negative, Stop does not wait.
+	ShutdownTimeout time.Duration
+
+	// The clock used for restart delays and the shutdown timeout. Defaults to
+	// clock.Real.
+	Clock clock.Clock
+}
+
+const defaultShutdownTimeout = 10 * time.Second
+
+func (cfg *Config) setDefaults() {
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real
+	}
+}
+
 type supervisor struct {
-	cch         chan SupervisionCommand
-	evch        chan SupervisionEvent
-	retryConfig net.Backoff
+	cfg      Config
+	cch      chan SupervisionCommand
+	evch     chan SupervisionEvent
+	doneChan chan struct{}
+	stopOnce sync.Once
+
+	mutex       sync.Mutex
+	running     bool
+	restarts    int
+	startTime   time.Time
+	lastExit    *monitor.Event
+	nextRestart time.Time
+	gaveUp      bool // restart limit exceeded
 }
 
+// Stops restarting the function, cancels its context and waits for it to
+// return, subject to the shutdown timeout.
 func (s *supervisor) Stop() {
-	s.cch <- SupervisionCommand{SCT_StopSupervising}
+	s.stopOnce.Do(func() {
+		s.cch <- SupervisionCommand{SCT_StopSupervising}
+	})
+	<-s.doneChan
 }
 
 func (s *supervisor) EventChan() <-chan SupervisionEvent {
 	return s.evch
 }
 
+func (s *supervisor) Status() Status {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cs := ChildStatus{
+		Name:      s.cfg.Name,
+		Restarts:  s.restarts,
+		StartTime: s.startTime,
+	}
+
+	switch {
+	case s.running:
+		cs.State = Running
+	case s.gaveUp:
+		cs.State = GaveUp
+	case !s.nextRestart.IsZero():
+		cs.State = Restarting
+		cs.NextRestart = s.nextRestart
+	case s.lastExit != nil:
+		cs.State = Exited
+	}
+
+	if s.lastExit != nil {
+		e := *s.lastExit
+		cs.LastExit = &e
+	}
+
+	select {
+	case <-s.doneChan:
+		cs.State = Stopped
+	default:
+	}
+
+	return Status{
+		Name:     s.cfg.Name,
+		Running:  cs.State != Stopped,
+		Children: []ChildStatus{cs},
+	}
+}
+
+// Records a change in the state of the supervised function.
+func (s *supervisor) update(f func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f()
+}
+
+func (s *supervisor) emit(e SupervisionEvent) {
+	select {
+	case s.evch <- e:
+	default:
+	}
+}
+
+// Runs a function in a goroutine, restarting it whenever it exits abnormally.
+//
+// The function cannot be interrupted; Stop only stops it from being
+// restarted. Use SuperviseContext for functions which can be asked to stop.
 func Supervise(f func() error) Supervisor {
+	return SuperviseContext(func(ctx context.Context) error {
+		return f()
+	}, Config{ShutdownTimeout: -1})
+}
+
+// Runs a function in a goroutine, restarting it whenever it exits abnormally.
+// Stop cancels the context passed to the function and waits for it to return.
+func SuperviseContext(f func(ctx context.Context) error, cfg Config) Supervisor {
+	cfg.setDefaults()
 	sup := &supervisor{
-		cch:  make(chan SupervisionCommand),
-		evch: make(chan SupervisionEvent, 10),
+		cfg:      cfg,
+		cch:      make(chan SupervisionCommand),
+		evch:     make(chan SupervisionEvent, 10),
+		doneChan: make(chan struct{}),
 	}
 
-	go func() {
-		ch := Monitor(f)
-		for {
-			select {
-			case e := <-ch:
-				if e.Type != MET_NormalExit || e.ReturnError != nil {
-					delay := time.Duration(sup.retryConfig.NextDelay()) * time.Millisecond
-					log.Info(fmt.Sprintf("supervised goroutine exited, restarting in %+v: %+v", delay, e))
-					time.Sleep(delay)
-					ch = Monitor(f)
-				} else {
-					sup.evch <- SupervisionEvent{SET_NormalExit}
+	register(sup)
+	go sup.loop(f)
+	return sup
+}
+
+func (sup *supervisor) loop(f func(ctx context.Context) error) {
+	defer close(sup.doneChan)
+	defer unregister(sup)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	run := func() error {
+		return f(ctx)
+	}
+
+	var startTime time.Time
+	start := func() <-chan monitor.Event {
+		startTime = sup.cfg.Clock.Now()
+		sup.update(func() {
+			sup.running = true
+			sup.startTime = startTime
+			sup.nextRestart = time.Time{}
+		})
+		return monitor.MonitorClock(sup.cfg.Clock, run)
+	}
+
+	ch := start()
+	var restartChan <-chan time.Time
+	var restartTimes []time.Time
+	for {
+		select {
+		case e := <-ch:
+			ch = nil
+			sup.update(func() {
+				sup.running = false
+				sup.lastExit = &e
+			})
+			if e.Abnormal() {
+				now := sup.cfg.Clock.Now()
+				var exceeded bool
+				restartTimes, exceeded = restartLimitExceeded(restartTimes, now, sup.cfg.MaxRestarts, sup.cfg.RestartWindow)
+				if exceeded {
+					sup.update(func() {
+						sup.gaveUp = true
+					})
+					log.Error(fmt.Sprintf("supervised goroutine exceeded restart limit, not restarting: %v", &e))
+					sup.emit(SupervisionEvent{Type: SET_RestartLimitExceeded, Child: sup.cfg.Name, Exit: e})
+					if sup.cfg.Criterion != nil {
+						sup.cfg.Criterion.SetStatus("supervised goroutine exceeded restart limit")
+						sup.cfg.Criterion.Dec()
+					}
+					break
 				}
 
-			case ce := <-sup.cch:
-				switch ce.Type {
-				case SCT_StopSupervising:
-					close(sup.cch)
-					sup.evch <- SupervisionEvent{SET_Stopped}
-					return
+				if sup.cfg.StablePeriod != 0 && now.Sub(startTime) >= sup.cfg.StablePeriod {
+					sup.cfg.Backoff.Reset()
 				}
+
+				delay := sup.cfg.Backoff.NextDelay()
+				sup.update(func() {
+					sup.nextRestart = sup.cfg.Clock.Now().Add(delay)
+				})
+				log.Info(fmt.Sprintf("supervised goroutine exited, restarting in %v: %v", delay, &e))
+				restartChan = sup.cfg.Clock.After(delay)
+			} else {
+				sup.emit(SupervisionEvent{Type: SET_NormalExit})
 			}
-		}
-	}()
 
-	return sup
+		case <-restartChan:
+			restartChan = nil
+			sup.update(func() {
+				sup.restarts++
+			})
+			ch = start()
+
+		case ce := <-sup.cch:
+			switch ce.Type {
+			case SCT_StopSupervising:
+				cancel()
+				if ch != nil && sup.cfg.ShutdownTimeout > 0 {
+					select {
+					case <-ch:
+					case <-sup.cfg.Clock.After(sup.cfg.ShutdownTimeout):
+						log.Warning("supervised goroutine did not exit within shutdown timeout")
+					}
+				}
+
+				sup.emit(SupervisionEvent{Type: SET_Stopped})
+				return
+			}
+		}
+	}
 }
@@ -0,0 +1,600 @@
+package supervise
+
+import "github.com/hlandau/degoutils/clock"
+import "github.com/hlandau/degoutils/health"
+import "github.com/hlandau/degoutils/log"
+import "github.com/hlandau/degoutils/monitor"
+import "github.com/hlandau/degoutils/net"
+import "golang.org/x/net/context"
+import "fmt"
+import "sync"
+import "time"
+
+// Determines which children are restarted when a child exits.
+type Strategy int
+
+const (
+	// Only the child which exited is restarted.
+	OneForOne Strategy = iota
+
+	// All running children are restarted.
+	OneForAll
+
+	// The child which exited and all running children added after it are
+	// restarted.
+	RestForOne
+)
+
+// Determines whether a child is restarted when it exits.
+type RestartPolicy int
+
+const (
+	// The child is restarted only if it exits abnormally, i.e. it panics, calls
+	// runtime.Goexit or returns a non-nil error. This is the behaviour of
+	// Supervise.
+	Transient RestartPolicy = iota
+
+	// The child is always restarted.
+	Permanent
+
+	// The child is never restarted.
+	Temporary
+)
+
+// Specifies a child of a Tree. Exactly one of Func, ContextFunc and Tree must
+// be set.
+type ChildSpec struct {
+	// The child name. Must be unique within the tree.
+	Name string
+
+	// A function to run.
+	//
+	// A running function cannot be interrupted. If the child is terminated,
+	// for example because the strategy requires it to be restarted after
+	// another child exited, the old goroutine is abandoned and its exit is
+	// ignored.
+	Func func() error
+
+	// A function to run which can be asked to stop. When the child is
+	// terminated, the context is cancelled and the tree waits for the function
+	// to return, subject to the shutdown timeout.
+	ContextFunc func(ctx context.Context) error
+
+	// A nested supervisor. It is started when the child is started and stopped
+	// when the child is terminated.
+	Tree *Tree
+
+	Restart RestartPolicy
+}
+
+// Supervision tree configuration.
+type TreeConfig struct {
+	// The name of the tree, used in status reports.
+	Name string
+
+	Strategy Strategy
+
+	// Restart delays. Each child has its own copy of this, so the delay grows
+	// each time that child is restarted.
+	Backoff net.Backoff
+
+	// If a child has run for at least this long when it exits, its backoff is
+	// reset before the restart delay is determined. If zero, the backoff is
+	// never reset.
+	StablePeriod time.Duration
+
+	// If nonzero, a child which exits more than MaxRestarts times within
+	// RestartWindow is not restarted again, and SET_RestartLimitExceeded is
+	// emitted.
+	MaxRestarts   int
+	RestartWindow time.Duration
+
+	// If set, this criterion is decremented for each child which has exceeded
+	// its restart limit, and incremented again if the child is restarted by
+	// the tree being restarted.
+	Criterion *health.Criterion
+
+	// If true, a child exceeding its restart limit causes the whole tree to
+	// terminate its children and exit with an error. If the tree is the child
+	// of another tree, the parent then handles the exit according to its own
+	// restart policy.
+	Escalate bool
+
+	// How long to wait for a ContextFunc child to return after its context is
+	// cancelled. If zero, 10 seconds is used. If negative, the tree does not
+	// wait.
+	ShutdownTimeout time.Duration
+
+	// The clock used for restart delays, restart windows and the shutdown
+	// timeout. Defaults to clock.Real.
+	Clock clock.Clock
+}
+
+// A supervisor with multiple named children, which may themselves be
+// supervisors.
+type Tree struct {
+	cfg      TreeConfig
+	mutex    sync.Mutex
+	children []*child
+	evch     chan SupervisionEvent
+	running  bool
+	doneChan chan struct{}
+	exitErr  error // if the tree escalated, why
+	nested   bool  // the tree is the child of another tree
+}
+
+type child struct {
+	spec ChildSpec
+
+	// Incremented whenever the child is started, terminated or scheduled for
+	// restart, so that exit notifications and restarts which have been
+	// superseded can be recognised and ignored.
+	gen int
+
+	running      bool
+	cancel       context.CancelFunc // for ContextFunc children
+	exited       chan struct{}      // closed when a function child returns
+	startTime    time.Time
+	backoff      net.Backoff
+	restarts     int
+	restartTimes []time.Time // times of exits within RestartWindow
+	gaveUp       bool        // restart limit exceeded
+	lastExit     *monitor.Event
+	nextRestart  time.Time // zero unless a restart is scheduled
+}
+
+// Creates a new supervision tree. Children are not started until Start is
+// called.
+func NewTree(cfg TreeConfig) *Tree {
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real
+	}
+
+	return &Tree{
+		cfg:  cfg,
+		evch: make(chan SupervisionEvent, 10),
+	}
+}
+
+// Adds a child. If the tree is running, the child is started immediately.
+func (t *Tree) Add(spec ChildSpec) error {
+	n := 0
+	if spec.Func != nil {
+		n++
+	}
+	if spec.ContextFunc != nil {
+		n++
+	}
+	if spec.Tree != nil {
+		n++
+	}
+	if n != 1 {
+		return fmt.Errorf("child %#v must have exactly one of Func, ContextFunc and Tree", spec.Name)
+	}
+	if spec.Tree == t {
+		return fmt.Errorf("tree cannot be a child of itself")
+	}
+	if spec.Tree != nil {
+		spec.Tree.mutex.Lock()
+		spec.Tree.nested = true
+		spec.Tree.mutex.Unlock()
+		unregister(spec.Tree)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, c := range t.children {
+		if c.spec.Name == spec.Name {
+			return fmt.Errorf("child %#v already exists", spec.Name)
+		}
+	}
+
+	c := &child{
+		spec:    spec,
+		backoff: t.cfg.Backoff,
+	}
+	t.children = append(t.children, c)
+	if t.running {
+		t.lStart(c)
+	}
+
+	return nil
+}
+
+// Starts all children, in the order in which they were added.
+func (t *Tree) Start() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.running {
+		return
+	}
+
+	t.running = true
+	t.doneChan = make(chan struct{})
+	t.exitErr = nil
+	if !t.nested {
+		register(t)
+	}
+	for _, c := range t.children {
+		t.lStart(c)
+	}
+}
+
+// Terminates all children, in the reverse of the order in which they were
+// added, and stops supervising them. The tree may be started again.
+//
+// All children are asked to stop before Stop waits for any of them to exit.
+func (t *Tree) Stop() {
+	t.stop()()
+}
+
+// Stops the tree and returns a function which waits for its children to exit.
+// The function must be called without the lock held.
+func (t *Tree) stop() func() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.running {
+		return func() {}
+	}
+
+	return t.lShutdown(nil, SupervisionEvent{Type: SET_Stopped})
+}
+
+// Terminates all children, in the reverse of the order in which they were
+// added, and marks the tree as stopped. The returned function waits for the
+// children to exit, then signals that the tree is done and emits e. It must be
+// called without the lock held. Lock must be held.
+func (t *Tree) lShutdown(exitErr error, e SupervisionEvent) func() {
+	t.running = false
+	t.exitErr = exitErr
+	unregister(t)
+
+	var waits []func()
+	for i := len(t.children) - 1; i >= 0; i-- {
+		waits = append(waits, t.lTerminate(t.children[i]))
+	}
+
+	done := t.doneChan
+	return func() {
+		for _, wait := range waits {
+			wait()
+		}
+
+		close(done)
+		t.emit(e)
+	}
+}
+
+func (t *Tree) EventChan() <-chan SupervisionEvent {
+	return t.evch
+}
+
+func (t *Tree) emit(e SupervisionEvent) {
+	select {
+	case t.evch <- e:
+	default:
+	}
+}
+
+// Starts a child. Lock must be held.
+func (t *Tree) lStart(c *child) {
+	c.gen++
+	c.running = true
+	c.nextRestart = time.Time{}
+	c.startTime = t.cfg.Clock.Now()
+	gen := c.gen
+
+	if c.gaveUp {
+		c.gaveUp = false
+		c.restartTimes = nil
+		if t.cfg.Criterion != nil {
+			t.cfg.Criterion.Inc()
+		}
+	}
+
+	if c.spec.Tree == nil {
+		f := c.spec.Func
+		if f == nil {
+			var ctx context.Context
+			ctx, c.cancel = context.WithCancel(context.Background())
+			cf := c.spec.ContextFunc
+			f = func() error {
+				return cf(ctx)
+			}
+		}
+
+		exited := make(chan struct{})
+		c.exited = exited
+		ch := monitor.MonitorClock(t.cfg.Clock, f)
+		go func() {
+			e := <-ch
+			close(exited)
+			t.childExited(c, gen, e)
+		}()
+		return
+	}
+
+	c.spec.Tree.Start()
+	done := c.spec.Tree.done()
+	startTime := c.startTime
+	go func() {
+		<-done
+		t.childExited(c, gen, monitor.Event{
+			Type:      monitor.NormalExit,
+			Error:     c.spec.Tree.exitError(),
+			StartTime: startTime,
+			ExitTime:  t.cfg.Clock.Now(),
+		})
+	}()
+}
+
+func (t *Tree) done() <-chan struct{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.doneChan
+}
+
+func (t *Tree) exitError() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.exitErr
+}
+
+// Terminates all children and exits with an error. The returned function is
+// as for lShutdown. Lock must be held.
+func (t *Tree) lEscalate(err error) func() {
+	return t.lShutdown(err, SupervisionEvent{Type: SET_Escalated, Exit: monitor.Event{
+		Type:  monitor.NormalExit,
+		Error: err,
+	}})
+}
+
+// Records a restart of a child and returns true if this exceeds the restart
+// limit. Lock must be held.
+func (t *Tree) lRestartLimitExceeded(c *child, now time.Time) bool {
+	var exceeded bool
+	c.restartTimes, exceeded = restartLimitExceeded(c.restartTimes, now, t.cfg.MaxRestarts, t.cfg.RestartWindow)
+	return exceeded
+}
+
+// Records a restart at now, given the times of previous restarts, and returns
+// the times of the restarts within the window and whether there are more than
+// max of them. If max is zero, there is no limit.
+func restartLimitExceeded(times []time.Time, now time.Time, max int, window time.Duration) ([]time.Time, bool) {
+	if max == 0 {
+		return nil, false
+	}
+
+	var times2 []time.Time
+	for _, rt := range times {
+		if now.Sub(rt) < window {
+			times2 = append(times2, rt)
+		}
+	}
+
+	times2 = append(times2, now)
+	return times2, len(times2) > max
+}
+
+// Terminates a child if it is running and cancels any pending restart. The
+// returned function waits for the child to exit, subject to the shutdown
+// timeout, and must be called without the lock held. Lock must be held.
+func (t *Tree) lTerminate(c *child) func() {
+	c.gen++
+	c.nextRestart = time.Time{}
+	if !c.running {
+		return func() {}
+	}
+
+	c.running = false
+	switch {
+	case c.spec.Tree != nil:
+		return c.spec.Tree.stop()
+
+	case c.spec.ContextFunc != nil:
+		c.cancel()
+		if t.cfg.ShutdownTimeout > 0 {
+			exited := c.exited
+			return func() {
+				select {
+				case <-exited:
+				case <-t.cfg.Clock.After(t.cfg.ShutdownTimeout):
+					log.Warning(fmt.Sprintf("child %#v did not exit within shutdown timeout", c.spec.Name))
+				}
+			}
+		}
+	}
+
+	return func() {}
+}
+
+func (t *Tree) childExited(c *child, gen int, e monitor.Event) {
+	t.mutex.Lock()
+	f := t.lChildExited(c, gen, e)
+	t.mutex.Unlock()
+
+	if f != nil {
+		f()
+	}
+}
+
+// Handles the exit of a child. Any children which must be terminated as a
+// result are asked to stop, and a function is returned which waits for them
+// to exit and then schedules any restarts. The function must be called without
+// the lock held. Lock must be held.
+func (t *Tree) lChildExited(c *child, gen int, e monitor.Event) func() {
+	if !t.running || gen != c.gen {
+		// terminated by us, or superseded
+		return nil
+	}
+
+	c.running = false
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.lastExit = &e
+	t.emit(SupervisionEvent{Type: SET_ChildExited, Child: c.spec.Name, Exit: e})
+
+	abnormal := e.Abnormal()
+	if abnormal {
+		log.Info(fmt.Sprintf("child %#v exited: %v", c.spec.Name, &e))
+	}
+
+	switch c.spec.Restart {
+	case Temporary:
+		return nil
+	case Transient:
+		if !abnormal {
+			return nil
+		}
+	}
+
+	now := t.cfg.Clock.Now()
+	if t.lRestartLimitExceeded(c, now) {
+		c.gaveUp = true
+		t.emit(SupervisionEvent{Type: SET_RestartLimitExceeded, Child: c.spec.Name, Exit: e})
+		if t.cfg.Criterion != nil {
+			t.cfg.Criterion.SetStatus(fmt.Sprintf("child %#v exceeded restart limit", c.spec.Name))
+			t.cfg.Criterion.Dec()
+		}
+		if t.cfg.Escalate {
+			return t.lEscalate(fmt.Errorf("child %#v exceeded restart limit", c.spec.Name))
+		}
+		return nil
+	}
+
+	if t.cfg.StablePeriod != 0 && now.Sub(c.startTime) >= t.cfg.StablePeriod {
+		c.backoff.Reset()
+	}
+
+	// Determine which children to restart.
+	var set []*child
+	for i, c2 := range t.children {
+		if c2 == c {
+			set = append(set, c2)
+			if t.cfg.Strategy == RestForOne {
+				for _, c3 := range t.children[i+1:] {
+					if c3.running {
+						set = append(set, c3)
+					}
+				}
+			}
+		} else if c2.running && t.cfg.Strategy == OneForAll {
+			set = append(set, c2)
+		}
+	}
+
+	var waits []func()
+	gens := make([]int, len(set))
+	for i, c2 := range set {
+		waits = append(waits, t.lTerminate(c2))
+		gens[i] = c2.gen
+	}
+
+	delay := c.backoff.NextDelay()
+	return func() {
+		for _, wait := range waits {
+			wait()
+		}
+
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+
+		if !t.running {
+			return
+		}
+
+		// Children which were started or terminated by someone else while
+		// waiting are left alone.
+		var set2 []*child
+		for i, c2 := range set {
+			if c2.gen == gens[i] {
+				set2 = append(set2, c2)
+			}
+		}
+		if len(set2) > 0 {
+			t.lScheduleRestart(set2, delay)
+		}
+	}
+}
+
+// Restarts a set of children, in order, after a delay. Lock must be held.
+func (t *Tree) lScheduleRestart(set []*child, delay time.Duration) {
+	gens := make([]int, len(set))
+	nextRestart := t.cfg.Clock.Now().Add(delay)
+	for i, c := range set {
+		c.gen++
+		gens[i] = c.gen
+		c.nextRestart = nextRestart
+	}
+
+	t.cfg.Clock.AfterFunc(delay, func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+
+		if !t.running {
+			return
+		}
+
+		for i, c := range set {
+			if c.gen == gens[i] && !c.running {
+				c.restarts++
+				t.lStart(c)
+				t.emit(SupervisionEvent{Type: SET_ChildRestarted, Child: c.spec.Name})
+			}
+		}
+	})
+}
+
+// Returns a snapshot of the tree and its children.
+func (t *Tree) Status() Status {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	s := Status{
+		Name:    t.cfg.Name,
+		Running: t.running,
+	}
+
+	for _, c := range t.children {
+		cs := ChildStatus{
+			Name:      c.spec.Name,
+			Restarts:  c.restarts,
+			StartTime: c.startTime,
+		}
+
+		switch {
+		case c.running:
+			cs.State = Running
+		case c.gaveUp:
+			cs.State = GaveUp
+		case !c.nextRestart.IsZero():
+			cs.State = Restarting
+			cs.NextRestart = c.nextRestart
+		case !t.running || c.lastExit == nil:
+			cs.State = Stopped
+		default:
+			cs.State = Exited
+		}
+
+		if c.lastExit != nil {
+			e := *c.lastExit
+			cs.LastExit = &e
+		}
+
+		if c.spec.Tree != nil {
+			ts := c.spec.Tree.Status()
+			cs.Tree = &ts
+		}
+
+		s.Children = append(s.Children, cs)
+	}
+
+	return s
+}
@@ -0,0 +1,375 @@
+package supervise
+
+import "github.com/hlandau/degoutils/clock"
+import "github.com/hlandau/degoutils/health"
+import "github.com/hlandau/degoutils/monitor"
+import "github.com/hlandau/degoutils/net"
+import "golang.org/x/net/context"
+import "fmt"
+import "net/http/httptest"
+import "strings"
+import "testing"
+import "time"
+
+var testBackoff = net.Backoff{
+	InitialDelay: 1 * time.Millisecond,
+	MaxDelay:     1 * time.Millisecond,
+}
+
+// Returns a child function which reports each start on a channel, then runs
+// until told to fail.
+func testChild(name string, started chan<- string) (func() error, chan error) {
+	fail := make(chan error, 1)
+	return func() error {
+		started <- name
+		return <-fail
+	}, fail
+}
+
+// Children run concurrently, so the order in which they report starting is
+// not checked.
+func expectStarts(t *testing.T, started <-chan string, names ...string) {
+	expected := map[string]int{}
+	for _, name := range names {
+		expected[name]++
+	}
+
+	for range names {
+		select {
+		case s := <-started:
+			if expected[s] == 0 {
+				t.Fatalf("unexpected start: %v", s)
+			}
+			expected[s]--
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected starts did not happen: %v", expected)
+		}
+	}
+
+	select {
+	case s := <-started:
+		t.Fatalf("unexpected start: %v", s)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func testStrategy(t *testing.T, strategy Strategy, restarted ...string) {
+	started := make(chan string, 10)
+	tr := NewTree(TreeConfig{Strategy: strategy, Backoff: testBackoff})
+	a, _ := testChild("a", started)
+	b, failB := testChild("b", started)
+	c, _ := testChild("c", started)
+	for _, spec := range []ChildSpec{{Name: "a", Func: a}, {Name: "b", Func: b}, {Name: "c", Func: c}} {
+		err := tr.Add(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tr.Start()
+	defer tr.Stop()
+	expectStarts(t, started, "a", "b", "c")
+
+	failB <- fmt.Errorf("failed")
+	expectStarts(t, started, restarted...)
+}
+
+func TestOneForOne(t *testing.T) {
+	testStrategy(t, OneForOne, "b")
+}
+
+func TestOneForAll(t *testing.T) {
+	testStrategy(t, OneForAll, "a", "b", "c")
+}
+
+func TestRestForOne(t *testing.T) {
+	testStrategy(t, RestForOne, "b", "c")
+}
+
+func TestNested(t *testing.T) {
+	started := make(chan string, 10)
+	inner := NewTree(TreeConfig{Backoff: testBackoff})
+	x, _ := testChild("x", started)
+	inner.Add(ChildSpec{Name: "x", Func: x})
+
+	outer := NewTree(TreeConfig{Strategy: OneForAll, Backoff: testBackoff})
+	a, failA := testChild("a", started)
+	outer.Add(ChildSpec{Name: "inner", Tree: inner})
+	outer.Add(ChildSpec{Name: "a", Func: a})
+
+	outer.Start()
+	expectStarts(t, started, "x", "a")
+
+	// Restarting the outer tree's children restarts the inner tree.
+	failA <- fmt.Errorf("failed")
+	expectStarts(t, started, "x", "a")
+
+	outer.Stop()
+	select {
+	case <-inner.done():
+	default:
+		t.Fatalf("inner tree not stopped")
+	}
+}
+
+func waitEvent(t *testing.T, sup Supervisor, typ int) SupervisionEvent {
+	for {
+		select {
+		case e := <-sup.EventChan():
+			if e.Type == typ {
+				return e
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("did not receive event %v", typ)
+		}
+	}
+}
+
+func TestRestartLimit(t *testing.T) {
+	r := health.NewRegistry()
+	crit := r.NewCriterion("workers", true)
+	tr := NewTree(TreeConfig{
+		Backoff:       testBackoff,
+		MaxRestarts:   2,
+		RestartWindow: time.Minute,
+		Criterion:     crit,
+	})
+
+	started := make(chan string, 10)
+	tr.Add(ChildSpec{Name: "crashy", Func: func() error {
+		started <- "crashy"
+		panic("crash")
+	}})
+
+	tr.Start()
+	defer tr.Stop()
+
+	e := waitEvent(t, tr, SET_RestartLimitExceeded)
+	if e.Child != "crashy" || e.Exit.Type != monitor.PanicExit {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+	expectStarts(t, started, "crashy", "crashy", "crashy")
+	if crit.OK() {
+		t.Fatalf("criterion not marked bad")
+	}
+}
+
+func TestEscalate(t *testing.T) {
+	started := make(chan string, 10)
+	inner := NewTree(TreeConfig{
+		Backoff:       testBackoff,
+		MaxRestarts:   1,
+		RestartWindow: time.Minute,
+		Escalate:      true,
+	})
+
+	n := 0
+	inner.Add(ChildSpec{Name: "x", Func: func() error {
+		started <- "x"
+		n++
+		if n <= 2 {
+			return fmt.Errorf("failed")
+		}
+		select {}
+	}})
+
+	outer := NewTree(TreeConfig{Backoff: testBackoff})
+	outer.Add(ChildSpec{Name: "inner", Tree: inner})
+	outer.Start()
+	defer outer.Stop()
+
+	// x fails twice, exceeding the inner tree's limit; the outer tree then
+	// restarts the inner tree, which restarts x.
+	e := waitEvent(t, outer, SET_ChildExited)
+	if e.Child != "inner" || e.Exit.Error == nil {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+	waitEvent(t, outer, SET_ChildRestarted)
+	expectStarts(t, started, "x", "x", "x")
+}
+
+func TestMonitorCompat(t *testing.T) {
+	e := <-Monitor(func() error {
+		panic("oops")
+	})
+	if e.Type != MET_PanicExit || e.PanicValue != "oops" || e.Event.Stack == nil {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+}
+
+func TestSuperviseContext(t *testing.T) {
+	started := make(chan struct{}, 10)
+	sup := SuperviseContext(func(ctx context.Context) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	}, Config{Backoff: testBackoff})
+
+	<-started
+	sup.Stop()
+	waitEvent(t, sup, SET_Stopped)
+	select {
+	case <-started:
+		t.Fatalf("function restarted after cancellation")
+	default:
+	}
+}
+
+func TestSuperviseRestartLimit(t *testing.T) {
+	r := health.NewRegistry()
+	crit := r.NewCriterion("worker", true)
+	started := make(chan string, 10)
+	sup := SuperviseContext(func(ctx context.Context) error {
+		started <- "worker"
+		return fmt.Errorf("failed")
+	}, Config{
+		Name:          "worker",
+		Backoff:       testBackoff,
+		MaxRestarts:   2,
+		RestartWindow: time.Minute,
+		Criterion:     crit,
+	})
+	defer sup.Stop()
+
+	e := waitEvent(t, sup, SET_RestartLimitExceeded)
+	if e.Child != "worker" || e.Exit.Error == nil {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+	expectStarts(t, started, "worker", "worker", "worker")
+	if crit.OK() {
+		t.Fatalf("criterion not marked bad")
+	}
+	if s := sup.Status(); !s.Running || s.Children[0].State != GaveUp {
+		t.Fatalf("unexpected status: %#v", s)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	clk := clock.NewSlow(nil)
+	started := make(chan struct{}, 1)
+	tr := NewTree(TreeConfig{Backoff: testBackoff, ShutdownTimeout: 5 * time.Second, Clock: clk})
+	err := tr.Add(ChildSpec{Name: "stubborn", ContextFunc: func(ctx context.Context) error {
+		started <- struct{}{}
+		select {} // ignores cancellation
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr.Start()
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		tr.Stop()
+		close(stopped)
+	}()
+
+	clk.BlockUntil(1)
+	select {
+	case <-stopped:
+		t.Fatalf("stop returned before shutdown timeout")
+	default:
+	}
+
+	// The tree is not locked while waiting.
+	if s := tr.Status(); s.Running || s.Children[0].State != Stopped {
+		t.Fatalf("unexpected status: %#v", s)
+	}
+
+	clk.Advance(5 * time.Second)
+	<-stopped
+}
+
+func TestShutdownTimeoutSibling(t *testing.T) {
+	clk := clock.NewSlow(nil)
+	started := make(chan string, 10)
+	tr := NewTree(TreeConfig{
+		Strategy:        OneForAll,
+		Backoff:         net.Backoff{InitialDelay: time.Second, MaxDelay: time.Second},
+		ShutdownTimeout: 5 * time.Second,
+		Clock:           clk,
+	})
+	crashy, fail := testChild("crashy", started)
+	tr.Add(ChildSpec{Name: "crashy", Func: crashy})
+	tr.Add(ChildSpec{Name: "stubborn", ContextFunc: func(ctx context.Context) error {
+		started <- "stubborn"
+		<-ctx.Done()
+		select {} // takes a while to exit
+	}})
+
+	tr.Start()
+	expectStarts(t, started, "crashy", "stubborn")
+
+	// While the tree waits for the stubborn child to exit, it can still be
+	// queried.
+	fail <- fmt.Errorf("failed")
+	waitEvent(t, tr, SET_ChildExited)
+	clk.BlockUntil(1)
+	if s := tr.Status(); !s.Running || s.Children[1].State == Running {
+		t.Fatalf("unexpected status: %#v", s)
+	}
+
+	// The restart is only scheduled once the wait is over.
+	clk.Advance(5 * time.Second)
+	clk.BlockUntil(1)
+	clk.Advance(time.Second)
+	expectStarts(t, started, "crashy", "stubborn")
+
+	stopped := make(chan struct{})
+	go func() {
+		tr.Stop()
+		close(stopped)
+	}()
+	clk.BlockUntil(1)
+	clk.Advance(5 * time.Second)
+	<-stopped
+}
+
+func TestStatus(t *testing.T) {
+	clk := clock.NewSlow(nil)
+	tr := NewTree(TreeConfig{
+		Name:    "workers",
+		Backoff: net.Backoff{InitialDelay: time.Minute, MaxDelay: time.Minute},
+		Clock:   clk,
+	})
+	err := tr.Add(ChildSpec{Name: "crashy", Func: func() error {
+		panic("kaboom")
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr.Start()
+	waitEvent(t, tr, SET_ChildExited)
+	clk.BlockUntil(1)
+
+	var s *Status
+	for _, s2 := range Supervisors() {
+		if s2.Name == "workers" {
+			s = &s2
+		}
+	}
+	if s == nil || !s.Running || len(s.Children) != 1 {
+		t.Fatalf("unexpected status: %#v", s)
+	}
+
+	c := s.Children[0]
+	if c.State != Restarting || c.LastExit == nil || c.LastExit.Panic != "kaboom" ||
+		!c.LastExit.ExitTime.Equal(clk.Now()) || !c.NextRestart.Equal(clk.Now().Add(time.Minute)) {
+		t.Fatalf("unexpected child status: %#v", c)
+	}
+
+	rw := httptest.NewRecorder()
+	Handler().ServeHTTP(rw, httptest.NewRequest("GET", "/supervise?format=json", nil))
+	if !strings.Contains(rw.Body.String(), `"panic":"kaboom"`) {
+		t.Fatalf("unexpected handler output: %s", rw.Body.String())
+	}
+
+	tr.Stop()
+	for _, s2 := range Supervisors() {
+		if s2.Name == "workers" {
+			t.Fatalf("stopped tree still listed")
+		}
+	}
+}
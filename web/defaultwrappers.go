@@ -273,7 +273,7 @@ func (cfg *Config) init() error {
 	}
 
 	cfg.statusChan = make(chan string, 8)
-	cfg.criterion = health.NewCriterion("web.ok", false)
+	cfg.criterion = health.NewProbeCriterion("web.ok", false, health.Readiness)
 	if cfg.HTTPServer.Server == nil {
 		cfg.HTTPServer.Server = &http.Server{}
 	}
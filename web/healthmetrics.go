@@ -0,0 +1,88 @@
+package web
+
+import (
+	"expvar"
+	"github.com/hlandau/degoutils/health"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+)
+
+// Exports the criteria of health registries which have a MetricPrefix. The
+// expvar variable "health" maps each prefix (without any trailing dot) to a
+// map from each criterion name to its value, ok (1 if good, otherwise 0) and
+// transitions. For Prometheus, each prefix yields the gauges PREFIX_value and
+// PREFIX_ok and the counter PREFIX_transitions_total, labelled with the
+// criterion name. Characters not valid in Prometheus metric names are replaced
+// with underscores.
+func registerHealthMetrics() {
+	expvar.Publish("health", expvar.Func(expvarHealth))
+	prometheus.MustRegister(healthCollector{})
+}
+
+type expvarCriterion struct {
+	Value       int64  `json:"value"`
+	OK          int64  `json:"ok"`
+	Transitions uint64 `json:"transitions"`
+}
+
+func expvarHealth() interface{} {
+	m := map[string]map[string]expvarCriterion{}
+	for _, hm := range health.Metrics() {
+		prefix := strings.TrimSuffix(hm.Prefix, ".")
+		if m[prefix] == nil {
+			m[prefix] = map[string]expvarCriterion{}
+		}
+		m[prefix][hm.Name] = expvarCriterion{hm.Value, boolMetric(hm.OK), hm.Transitions}
+	}
+	return m
+}
+
+func boolMetric(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+type healthCollector struct{}
+
+// Metric names depend on the prefixes in use, so no descriptions are provided
+// in advance.
+func (healthCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (healthCollector) Collect(ch chan<- prometheus.Metric) {
+	var prefix string
+	var value, ok, transitions *prometheus.Desc
+	for _, hm := range health.Metrics() {
+		if value == nil || hm.Prefix != prefix {
+			prefix = hm.Prefix
+			p := prometheusName(prefix)
+			value = prometheus.NewDesc(p+"value", "Health criterion counter.", []string{"criterion"}, nil)
+			ok = prometheus.NewDesc(p+"ok", "1 if the health criterion is good, otherwise 0.", []string{"criterion"}, nil)
+			transitions = prometheus.NewDesc(p+"transitions_total", "Health criterion transitions between good and bad.", []string{"criterion"}, nil)
+		}
+
+		ch <- prometheus.MustNewConstMetric(value, prometheus.GaugeValue, float64(hm.Value), hm.Name)
+		ch <- prometheus.MustNewConstMetric(ok, prometheus.GaugeValue, float64(boolMetric(hm.OK)), hm.Name)
+		ch <- prometheus.MustNewConstMetric(transitions, prometheus.CounterValue, float64(hm.Transitions), hm.Name)
+	}
+}
+
+// Converts a prefix to a valid Prometheus metric name prefix ending in an
+// underscore, by replacing invalid characters with underscores.
+func prometheusName(prefix string) string {
+	b := []byte(prefix)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && c != '_' && c != ':' &&
+			!(c >= '0' && c <= '9' && i > 0) {
+			b[i] = '_'
+		}
+	}
+
+	s := string(b)
+	if !strings.HasSuffix(s, "_") {
+		s += "_"
+	}
+	return s
+}
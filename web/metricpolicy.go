@@ -8,4 +8,5 @@ import (
 func init() {
 	adaptexpvar.Register()
 	adaptprometheus.Register()
+	registerHealthMetrics()
 }